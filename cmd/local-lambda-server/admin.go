@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// adminHandler serves local-lambda-server endpoints used in tests,
+//
+//	GET  /schedules             lists schedule rules
+//	POST /schedules/{name}/run  triggers next scheduled run immediately
+func adminHandler(sched *scheduler) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/schedules", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sched.Rules())
+	})
+
+	mux.HandleFunc("/schedules/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/schedules/")
+		if r.Method != http.MethodPost || !strings.HasSuffix(name, "/run") {
+			http.NotFound(w, r)
+			return
+		}
+		if !sched.Run(strings.TrimSuffix(name, "/run")) {
+			http.Error(w, "schedule rule not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	return mux
+}
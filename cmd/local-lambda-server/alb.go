@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// albTargetGroupArn returns arn of target group the server pretends to
+// be.
+func albTargetGroupArn() string {
+	return fmt.Sprintf("arn:aws:elasticloadbalancing:%s:%s:targetgroup/local-lambda-server/0123456789abcdef", *region, accountID)
+}
+
+// albRequest is the event passed to lambda targets of an Application Load
+// Balancer target group.
+type albRequest struct {
+	RequestContext struct {
+		ELB struct {
+			TargetGroupArn string `json:"targetGroupArn"`
+		} `json:"elb"`
+	} `json:"requestContext"`
+	HTTPMethod                      string              `json:"httpMethod"`
+	Path                            string              `json:"path"`
+	QueryStringParameters           map[string]string   `json:"queryStringParameters,omitempty"`
+	MultiValueQueryStringParameters map[string][]string `json:"multiValueQueryStringParameters,omitempty"`
+	Headers                         map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders               map[string][]string `json:"multiValueHeaders,omitempty"`
+	Body                            string              `json:"body"`
+	IsBase64Encoded                 bool                `json:"isBase64Encoded"`
+}
+
+// albResponse is the response lambda targets return to the load balancer.
+type albResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	StatusDescription string              `json:"statusDescription"`
+	Headers           map[string]string   `json:"headers"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+func albHandler(invoke invokeFunc, multiValue bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.Background()
+
+		event, err := newALBRequest(r, multiValue)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
+
+		payload, err := json.Marshal(event)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		response, err := invoke(ctx, payload)
+		if err != nil {
+			// like alb, throttled function is unavailable and failed
+			// one is bad gateway
+			status := http.StatusInternalServerError
+			switch err {
+			case errThrottled, errReservedThrottled:
+				status = http.StatusServiceUnavailable
+			case errFunctionError:
+				status = http.StatusBadGateway
+			}
+			http.Error(w, http.StatusText(status), status)
+			log.Println(err)
+			return
+		}
+
+		if err := writeALBResponse(w, response, multiValue); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			log.Println("alb:", err)
+			return
+		}
+	}
+}
+
+func newALBRequest(r *http.Request, multiValue bool) (*albRequest, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	event := new(albRequest)
+	event.RequestContext.ELB.TargetGroupArn = albTargetGroupArn()
+	event.HTTPMethod = r.Method
+	event.Path = r.URL.EscapedPath()
+
+	// ALB passes query parameters to targets without decoding them
+	query := make(map[string][]string)
+	for _, kv := range strings.Split(r.URL.RawQuery, "&") {
+		if kv == "" {
+			continue
+		}
+		var k, v string
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			k, v = kv[:i], kv[i+1:]
+		} else {
+			k = kv
+		}
+		query[k] = append(query[k], v)
+	}
+
+	headers := make(map[string][]string)
+	for k, v := range r.Header {
+		headers[strings.ToLower(k)] = v
+	}
+	headers["host"] = []string{r.Host}
+
+	if multiValue {
+		event.MultiValueQueryStringParameters = query
+		event.MultiValueHeaders = headers
+	} else {
+		// without multi-value support ALB forwards the last value
+		event.QueryStringParameters = make(map[string]string)
+		for k, v := range query {
+			event.QueryStringParameters[k] = v[len(v)-1]
+		}
+		event.Headers = make(map[string]string)
+		for k, v := range headers {
+			event.Headers[k] = v[len(v)-1]
+		}
+	}
+
+	if isTextContent(r.Header.Get("Content-Type")) && r.Header.Get("Content-Encoding") == "" {
+		event.Body = string(body)
+	} else if len(body) > 0 {
+		event.Body = base64.StdEncoding.EncodeToString(body)
+		event.IsBase64Encoded = true
+	}
+
+	return event, nil
+}
+
+func writeALBResponse(w http.ResponseWriter, data []byte, multiValue bool) error {
+	var resp albResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+
+	body := []byte(resp.Body)
+	if resp.IsBase64Encoded {
+		var err error
+		body, err = base64.StdEncoding.DecodeString(resp.Body)
+		if err != nil {
+			return err
+		}
+	}
+
+	if multiValue {
+		for k, v := range resp.MultiValueHeaders {
+			for _, vv := range v {
+				w.Header().Add(k, vv)
+			}
+		}
+	} else {
+		for k, v := range resp.Headers {
+			w.Header().Set(k, v)
+		}
+	}
+
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+	return nil
+}
+
+func isTextContent(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(t, "text/"):
+		return true
+	case t == "application/json",
+		t == "application/javascript",
+		t == "application/xml",
+		t == "application/x-www-form-urlencoded":
+		return true
+	}
+	return strings.HasSuffix(t, "+json") || strings.HasSuffix(t, "+xml")
+}
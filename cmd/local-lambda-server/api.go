@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/dzeromsk/subslicer"
+)
+
+const invokePathPrefix = "/2015-03-31/functions/"
+
+// lambdaAPI serves lambda Invoke api,
+// POST /2015-03-31/functions/{name}/invocations.
+type lambdaAPI struct {
+	reg   *registry
+	queue *asyncQueue
+}
+
+func (api *lambdaAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, invokePathPrefix)
+	if r.Method != http.MethodPost || !strings.HasSuffix(path, "/invocations") {
+		writeAPIError(w, http.StatusNotFound, "UnknownOperationException", "Unknown operation")
+		return
+	}
+	name := strings.TrimSuffix(path, "/invocations")
+	if q := r.URL.Query().Get("Qualifier"); q != "" && q != "$LATEST" {
+		writeAPIError(w, http.StatusNotFound, "ResourceNotFoundException", "Function not found: "+name+":"+q)
+		return
+	}
+	api.invoke(w, r, name)
+}
+
+// Handler returns handler invoking function by name, used for the
+// default function served at /.
+func (api *lambdaAPI) Handler(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		api.invoke(w, r, name)
+	}
+}
+
+func (api *lambdaAPI) invoke(w http.ResponseWriter, r *http.Request, name string) {
+	// TODO(dzeromsk): context with timeout
+	ctx := context.Background()
+	if trace := r.Header.Get("X-Amzn-Trace-Id"); trace != "" {
+		// call chain of nested invocation
+		ctx = subslicer.WithTraceID(ctx, trace)
+	}
+
+	fn, ok := api.reg.Lookup(name)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "ResourceNotFoundException", "Function not found: "+name)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "InvalidRequestContentException", err.Error())
+		return
+	}
+
+	switch r.Header.Get("X-Amz-Invocation-Type") {
+	case "", "RequestResponse":
+	case "Event":
+		id, err := api.queue.Enqueue(fn.Name, payload, subslicer.TraceID(ctx))
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "ServiceException", err.Error())
+			log.Println(err)
+			return
+		}
+		w.Header().Set("X-Amzn-RequestId", id)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case "DryRun":
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeAPIError(w, http.StatusBadRequest, "InvalidParameterValueException", "Unsupported invocation type")
+		return
+	}
+
+	var response []byte
+	if header := r.Header.Get("X-Local-Environment"); header != "" {
+		// environment override for tests, json object of variables.
+		// Functions reach this api too, so it is off by default.
+		if !*envOverride {
+			writeAPIError(w, http.StatusBadRequest, "InvalidParameterValueException", "X-Local-Environment requires -env-override")
+			return
+		}
+		var env map[string]string
+		if err := json.Unmarshal([]byte(header), &env); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "InvalidParameterValueException", "X-Local-Environment: "+err.Error())
+			return
+		}
+		if err := validateEnv(env); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "InvalidParameterValueException", err.Error())
+			return
+		}
+		response, err = api.reg.invokeWithEnv(ctx, fn, payload, env)
+	} else {
+		response, err = api.reg.invoke(ctx, fn, payload)
+	}
+	switch err {
+	case nil:
+	case errFunctionError:
+		w.Header().Set("X-Amz-Function-Error", "Unhandled")
+	case errThrottled, errReservedThrottled:
+		writeThrottled(w, err)
+		return
+	case errRecursion:
+		writeAPIError(w, http.StatusBadRequest, "RecursiveInvocationException", "Function "+fn.Name+" was stopped in recursive invocation loop")
+		return
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "ServiceException", err.Error())
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("X-Amz-Executed-Version", "$LATEST")
+	w.Write(response)
+}
+
+// sandboxAddr returns address of listener as seen from sandboxes, listener
+// on all interfaces is reached on loopback.
+func sandboxAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, errorType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Amzn-ErrorType", errorType)
+	w.WriteHeader(status)
+	kind := "User"
+	if status >= http.StatusInternalServerError {
+		kind = "Service"
+	}
+	json.NewEncoder(w).Encode(struct {
+		Type    string `json:"Type"`
+		Message string `json:"message"`
+	}{kind, message})
+}
+
+// writeThrottled writes TooManyRequestsException with the reason of
+// throttling.
+func writeThrottled(w http.ResponseWriter, err error) {
+	reason := "ConcurrentInvocationLimitExceeded"
+	if err == errReservedThrottled {
+		reason = "ReservedFunctionConcurrentInvocationLimitExceeded"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Amzn-ErrorType", "TooManyRequestsException")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(struct {
+		Reason  string `json:"Reason"`
+		Type    string `json:"Type"`
+		Message string `json:"message"`
+	}{reason, "User", "Rate Exceeded."})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dzeromsk/subslicer"
+)
+
+// asyncEvent is a queued asynchronous invocation, stored as a json file in
+// queue directory until processed.
+type asyncEvent struct {
+	RequestID  string    `json:"requestId"`
+	Function   string    `json:"function"`
+	Payload    []byte    `json:"payload"`
+	EnqueuedAt time.Time `json:"enqueuedAt"`
+	Attempts   int       `json:"attempts"`
+	Throttles  int       `json:"throttles"`
+	NotBefore  time.Time `json:"notBefore"`
+	// TraceHeader of caller, loops through queue are detected
+	TraceHeader string `json:"traceHeader,omitempty"`
+}
+
+// asyncRecord is the invocation record sent to destinations.
+type asyncRecord struct {
+	Version        string `json:"version"`
+	Timestamp      string `json:"timestamp"`
+	RequestContext struct {
+		RequestID              string `json:"requestId"`
+		FunctionArn            string `json:"functionArn"`
+		Condition              string `json:"condition"`
+		ApproximateInvokeCount int    `json:"approximateInvokeCount"`
+	} `json:"requestContext"`
+	RequestPayload  json.RawMessage       `json:"requestPayload"`
+	ResponseContext *asyncResponseContext `json:"responseContext,omitempty"`
+	ResponsePayload json.RawMessage       `json:"responsePayload,omitempty"`
+}
+
+type asyncResponseContext struct {
+	StatusCode      int    `json:"statusCode"`
+	ExecutedVersion string `json:"executedVersion"`
+	FunctionError   string `json:"functionError,omitempty"`
+}
+
+// asyncQueue is a persistent queue of asynchronous invocations. Failed
+// invocations are retried with Lambda delays scaled by retryDelay, then
+// delivered to the OnSuccess or OnFailure destination of the function.
+type asyncQueue struct {
+	reg        *registry
+	dir        string
+	retryDelay time.Duration
+	events     chan *asyncEvent
+}
+
+// newAsyncQueue returns queue with events left in dir by previous run
+// scheduled, before Enqueue stores new ones there.
+func newAsyncQueue(reg *registry, dir string, retryDelay time.Duration) (*asyncQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &asyncQueue{
+		reg:        reg,
+		dir:        dir,
+		retryDelay: retryDelay,
+		events:     make(chan *asyncEvent, 128),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Enqueue stores payload for asynchronous invocation of function with
+// trace header of caller, if any, and returns request id.
+func (q *asyncQueue) Enqueue(name string, payload []byte, trace string) (string, error) {
+	e := &asyncEvent{
+		RequestID:   requestID(),
+		Function:    name,
+		Payload:     payload,
+		EnqueuedAt:  time.Now(),
+		TraceHeader: trace,
+	}
+	e.NotBefore = e.EnqueuedAt
+	if err := q.store(e); err != nil {
+		return "", err
+	}
+	q.schedule(e)
+	return e.RequestID, nil
+}
+
+// Serve processes queued events.
+func (q *asyncQueue) Serve() error {
+	for e := range q.events {
+		go q.process(e)
+	}
+	return nil
+}
+
+// load schedules events of known functions stored in queue directory.
+func (q *asyncQueue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(q.dir, file.Name()))
+		if err != nil {
+			return err
+		}
+		e := new(asyncEvent)
+		if err := json.Unmarshal(data, e); err != nil {
+			log.Println("async: skipping", file.Name(), err)
+			continue
+		}
+		// queue dir may be shared with server of another config, its
+		// events are kept
+		if _, ok := q.reg.Lookup(e.Function); !ok {
+			log.Println("async: skipping", file.Name(), "of unknown function", e.Function)
+			continue
+		}
+		q.schedule(e)
+	}
+	return nil
+}
+
+func (q *asyncQueue) schedule(e *asyncEvent) {
+	if d := time.Until(e.NotBefore); d > 0 {
+		time.AfterFunc(d, func() { q.events <- e })
+		return
+	}
+	go func() { q.events <- e }()
+}
+
+func (q *asyncQueue) process(e *asyncEvent) {
+	fn, ok := q.reg.Lookup(e.Function)
+	if !ok {
+		// function may be back after reload or restart
+		log.Println("async: function not found, keeping", e.RequestID, "for", e.Function)
+		return
+	}
+
+	if time.Since(e.EnqueuedAt) > time.Duration(fn.Async.MaximumEventAgeInSeconds)*time.Second {
+		log.Println("async: event age exceeded:", e.RequestID)
+		q.deliver(fn, e, "EventAgeExceeded", nil, nil)
+		return
+	}
+
+	ctx := context.Background()
+	if e.TraceHeader != "" {
+		ctx = subslicer.WithTraceID(ctx, e.TraceHeader)
+	}
+	response, err := q.reg.invoke(ctx, fn, e.Payload)
+	if err == errThrottled || err == errReservedThrottled {
+		// throttled events stay queued until event age is exceeded,
+		// retries back off up to 5 minutes and do not count as attempts
+		delay := time.Second << uint(e.Throttles)
+		if delay > 5*time.Minute || delay <= 0 {
+			delay = 5 * time.Minute
+		}
+		e.Throttles++
+		e.NotBefore = time.Now().Add(delay)
+		if err := q.store(e); err != nil {
+			log.Println("async:", err)
+		}
+		q.schedule(e)
+		return
+	}
+	if err == errRecursion {
+		// loop is stopped, event is not retried
+		log.Println("async:", e.RequestID, err)
+		q.deliver(fn, e, "RecursiveInvocationDetected", nil, err)
+		return
+	}
+
+	e.Attempts++
+	switch err {
+	case nil:
+		q.deliver(fn, e, "Success", response, nil)
+		return
+	case errFunctionError:
+	default:
+		// service errors, like failed init, count as attempts too so
+		// broken function does not retry until event age is exceeded
+		log.Println("async:", e.RequestID, err)
+	}
+	if e.Attempts > *fn.Async.MaximumRetryAttempts {
+		q.deliver(fn, e, "RetriesExhausted", response, err)
+		return
+	}
+
+	// lambda waits one minute before the first retry and two minutes
+	// before the second one
+	e.NotBefore = time.Now().Add(time.Duration(e.Attempts) * q.retryDelay)
+	if err := q.store(e); err != nil {
+		log.Println("async:", err)
+	}
+	log.Println("async: retry", e.RequestID, "attempt", e.Attempts+1, "at", e.NotBefore.Format(time.RFC3339))
+	q.schedule(e)
+}
+
+func (q *asyncQueue) deliver(fn *function, e *asyncEvent, condition string, response []byte, err error) {
+	defer q.remove(e)
+
+	var destination string
+	if condition == "Success" {
+		destination = fn.Async.DestinationConfig.OnSuccess.Destination
+	} else {
+		destination = fn.Async.DestinationConfig.OnFailure.Destination
+	}
+	if destination == "" {
+		return
+	}
+
+	record := new(asyncRecord)
+	record.Version = "1.0"
+	record.Timestamp = time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	record.RequestContext.RequestID = e.RequestID
+	record.RequestContext.FunctionArn = functionArn(fn.Name) + ":$LATEST"
+	record.RequestContext.Condition = condition
+	record.RequestContext.ApproximateInvokeCount = e.Attempts
+	record.RequestPayload = rawJSON(e.Payload)
+	// function returned a response, service errors like failed init
+	// have none
+	if condition == "Success" || (condition == "RetriesExhausted" && err == errFunctionError) {
+		record.ResponseContext = &asyncResponseContext{
+			StatusCode:      200,
+			ExecutedVersion: "$LATEST",
+		}
+		if err == errFunctionError {
+			record.ResponseContext.FunctionError = "Unhandled"
+		}
+		record.ResponsePayload = rawJSON(response)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Println("async:", err)
+		return
+	}
+
+	if target, ok := q.reg.Lookup(destination); ok {
+		if _, err := q.Enqueue(target.Name, data, e.TraceHeader); err != nil {
+			log.Println("async:", err)
+		}
+		return
+	}
+
+	// not a function, treat destination as dead-letter directory
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		log.Println("async:", err)
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(destination, e.RequestID+".json"), data, 0644); err != nil {
+		log.Println("async:", err)
+	}
+}
+
+func (q *asyncQueue) store(e *asyncEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// write and rename so a crash never leaves partial event behind
+	tmp := filepath.Join(q.dir, e.RequestID+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path(e))
+}
+
+func (q *asyncQueue) remove(e *asyncEvent) {
+	if err := os.Remove(q.path(e)); err != nil && !os.IsNotExist(err) {
+		log.Println("async:", err)
+	}
+}
+
+func (q *asyncQueue) path(e *asyncEvent) string {
+	return filepath.Join(q.dir, e.RequestID+".json")
+}
+
+// defaultAsyncDir returns queue directory of config, or task dir when
+// there is no config, so servers of different functions do not replay
+// events of each other.
+func defaultAsyncDir() (string, error) {
+	base, err := cacheDir("async")
+	if err != nil {
+		return "", err
+	}
+	source := *task
+	if *configFile != "" {
+		source = *configFile
+	}
+	if abs, err := filepath.Abs(source); err == nil {
+		source = abs
+	}
+	sum := sha256.Sum256([]byte(source))
+	return filepath.Join(base, hex.EncodeToString(sum[:8])), nil
+}
+
+// rawJSON returns data as json value, payloads that are not valid json are
+// encoded as strings.
+func rawJSON(data []byte) json.RawMessage {
+	if len(data) == 0 {
+		return json.RawMessage("null")
+	}
+	if json.Valid(data) {
+		return json.RawMessage(data)
+	}
+	s, _ := json.Marshal(string(data))
+	return json.RawMessage(s)
+}
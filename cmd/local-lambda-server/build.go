@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// build runs build command of function in its task dir, output is shown
+// in server log.
+func build(fn *function) error {
+	log.Println("Building lambda function:", fn.Name, fn.Build)
+	start := time.Now()
+
+	cmd := exec.Command("/bin/sh", "-c", fn.Build)
+	cmd.Dir = fn.Task
+	cmd.Env = os.Environ()
+
+	r, w := io.Pipe()
+	cmd.Stdout = w
+	cmd.Stderr = w
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			log.Println("build:", fn.Name, s.Text())
+		}
+		// drain long lines
+		io.Copy(ioutil.Discard, r)
+	}()
+
+	err := cmd.Run()
+	w.Close()
+	<-done
+
+	if err != nil {
+		log.Println("Build failed:", fn.Name, err)
+		return err
+	}
+	log.Println("Built lambda function:", fn.Name, time.Since(start).Round(time.Millisecond))
+	return nil
+}
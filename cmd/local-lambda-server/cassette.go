@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"unicode/utf8"
+)
+
+// cassette holds recorded HTTP interactions of function.
+type cassette struct {
+	path string
+
+	m            sync.Mutex
+	Interactions []*interaction `json:"interactions"`
+	// replayed interactions are matched again only when there are no
+	// others left
+	used []bool
+}
+
+type interaction struct {
+	Request  recordedRequest  `json:"request"`
+	Response recordedResponse `json:"response"`
+}
+
+type recordedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"headers"`
+	recordedBody
+}
+
+type recordedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"headers"`
+	recordedBody
+}
+
+// recordedBody is kept as text, binary bodies are base64 encoded.
+type recordedBody struct {
+	Body         string `json:"body"`
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+}
+
+func newBody(data []byte) recordedBody {
+	if utf8.Valid(data) {
+		return recordedBody{Body: string(data)}
+	}
+	return recordedBody{Body: base64.StdEncoding.EncodeToString(data), BodyEncoding: "base64"}
+}
+
+func (b recordedBody) bytes() []byte {
+	if b.BodyEncoding == "base64" {
+		data, _ := base64.StdEncoding.DecodeString(b.Body)
+		return data
+	}
+	return []byte(b.Body)
+}
+
+// loadCassette reads cassette file for replay.
+func loadCassette(path string) (*cassette, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &cassette{path: path}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	c.used = make([]bool, len(c.Interactions))
+	return c, nil
+}
+
+// Match returns first interaction not replayed yet with the same method,
+// url and body. Once all of them are replayed the last one is repeated,
+// so warm instances get the same responses again.
+func (c *cassette) Match(method, url string, body []byte) *interaction {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var last *interaction
+	for i, it := range c.Interactions {
+		if it.Request.Method != method || it.Request.URL != url {
+			continue
+		}
+		if string(it.Request.bytes()) != string(body) {
+			continue
+		}
+		if !c.used[i] {
+			c.used[i] = true
+			return it
+		}
+		last = it
+	}
+	return last
+}
+
+// Record appends interaction and saves cassette, so it survives crashes.
+func (c *cassette) Record(it *interaction) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.Interactions = append(c.Interactions, it)
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
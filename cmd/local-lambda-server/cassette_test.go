@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestCassetteMatch(t *testing.T) {
+	it := func(method, url, body string, status int) *interaction {
+		i := &interaction{}
+		i.Request.Method, i.Request.URL, i.Request.Body = method, url, body
+		i.Response.Status = status
+		return i
+	}
+	c := &cassette{Interactions: []*interaction{
+		it("GET", "http://a/x", "", 200),
+		it("GET", "http://a/x", "", 201),
+		it("POST", "http://a/x", "one", 202),
+	}}
+	c.used = make([]bool, len(c.Interactions))
+
+	tests := []struct {
+		method, url, body string
+		status            int
+	}{
+		{"GET", "http://a/x", "", 200},
+		{"GET", "http://a/x", "", 201},
+		// warm instance repeats the request
+		{"GET", "http://a/x", "", 201},
+		{"POST", "http://a/x", "one", 202},
+		{"POST", "http://a/x", "one", 202},
+		{"POST", "http://a/x", "two", 0},
+		{"GET", "http://a/y", "", 0},
+	}
+	for _, tt := range tests {
+		got := c.Match(tt.method, tt.url, []byte(tt.body))
+		status := 0
+		if got != nil {
+			status = got.Response.Status
+		}
+		if status != tt.status {
+			t.Errorf("Match(%s %s %q) = %d, want %d", tt.method, tt.url, tt.body, status, tt.status)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Config describes functions served by local-lambda-server and the event
+// sources that invoke them.
+type Config struct {
+	Functions []*FunctionConfig `json:"functions"`
+	WebSocket *WebSocketConfig  `json:"websocket,omitempty"`
+
+	Queues              []*QueueConfig        `json:"queues"`
+	EventSourceMappings []*EventSourceMapping `json:"eventSourceMappings"`
+	Streams             []*StreamConfig       `json:"streams"`
+	Rules               []*RuleConfig         `json:"rules"`
+	Buckets             []*BucketConfig       `json:"buckets"`
+	Topics              []*TopicConfig        `json:"topics"`
+}
+
+// FunctionConfig describes a single lambda function.
+type FunctionConfig struct {
+	Name    string `json:"name"`
+	Runtime string `json:"runtime"`
+	Handler string `json:"handler"`
+	Task    string `json:"task"`
+	// Zip is deployment package served instead of task dir, task dir
+	// defaults to dir of the zip. Function is reloaded when zip changes.
+	Zip string `json:"zip"`
+	// Role is execution role arn assumed with host credentials, without
+	// role functions get host credentials.
+	Role string `json:"role"`
+	// MemorySize in MB, defaults to 128.
+	MemorySize int `json:"memorySize"`
+
+	// ReservedConcurrentExecutions reserves part of workers for function
+	// and limits its concurrency, zero throttles all invocations.
+	ReservedConcurrentExecutions *int `json:"reservedConcurrentExecutions"`
+	// ProvisionedConcurrentExecutions instances are started ahead of
+	// invocations and kept warm.
+	ProvisionedConcurrentExecutions int `json:"provisionedConcurrentExecutions"`
+
+	// IdleTimeoutInSeconds, MaxLifetimeInSeconds and MaxInvocations
+	// recycle instances, zero means no limit. Defaults are taken from
+	// command line flags.
+	IdleTimeoutInSeconds int `json:"idleTimeoutInSeconds"`
+	MaxLifetimeInSeconds int `json:"maxLifetimeInSeconds"`
+	MaxInvocations       int `json:"maxInvocations"`
+
+	// Watch configures reload on changes in task dir.
+	Watch WatchConfig `json:"watch"`
+	// Layers are dirs or zip files merged in order into /opt, at most 5.
+	Layers []string `json:"layers"`
+	// Environment variables of function, merged over runtime defaults.
+	Environment EnvironmentConfig `json:"environment"`
+	// Endpoints redirect AWS SDK calls of function to local stand-ins.
+	Endpoints EndpointsConfig `json:"endpoints"`
+	// Network isolates instances from host network.
+	Network NetworkConfig `json:"network"`
+	// Cassette records or replays outbound HTTP traffic of function.
+	Cassette CassetteConfig `json:"cassette"`
+
+	// Build is shell command run in task dir at startup and before
+	// reload, like go build -o handler. Failed build keeps serving
+	// previous instances.
+	Build string `json:"build"`
+
+	// Schedules invoke function with scheduled events.
+	Schedules []*ScheduleConfig `json:"schedules"`
+
+	// Async configures asynchronous invocation, like function event
+	// invoke config in lambda api.
+	Async AsyncConfig `json:"async"`
+}
+
+// EnvironmentConfig describes environment variables of function,
+// Variables override ones read from EnvFile.
+type EnvironmentConfig struct {
+	Variables map[string]string `json:"variables"`
+	// EnvFile has KEY=value lines, defaults to -env-file flag.
+	EnvFile string `json:"envFile"`
+}
+
+// EndpointsConfig overrides AWS service endpoints inside sandbox.
+type EndpointsConfig struct {
+	// URLs maps service ids, like dynamodb or s3, to urls set in
+	// AWS_ENDPOINT_URL_<SERVICE> variables, default sets AWS_ENDPOINT_URL
+	// used for all services.
+	URLs map[string]string `json:"urls"`
+	// Hosts maps host names to addresses, they are added to /etc/hosts
+	// mounted into sandbox.
+	Hosts map[string]string `json:"hosts"`
+}
+
+// NetworkConfig runs each instance in own network namespace with loopback
+// and veth pair to host, egress goes through NAT on host.
+type NetworkConfig struct {
+	Isolated bool `json:"isolated"`
+	// Egress allows only listed destinations, host names, addresses or
+	// cidrs with optional port, like example.com:443 or 10.0.0.0/8.
+	// Setting it isolates instances.
+	Egress []string `json:"egress"`
+	// Offline blocks all egress, like VPC function without NAT. Setting
+	// it isolates instances.
+	Offline bool `json:"offline"`
+	// Forward makes host loopback addresses, like 127.0.0.1:8000 of
+	// local emulator, reachable at the same address in sandbox.
+	Forward []string `json:"forward"`
+}
+
+// CassetteConfig describes HTTP(S) proxy of function recording requests
+// and responses to cassette file or replaying them.
+type CassetteConfig struct {
+	// Mode is record or replay, defaults to -cassette flag. Empty mode
+	// sends requests directly.
+	Mode string `json:"mode"`
+	// Path of cassette file, defaults to function name in -cassette-dir.
+	Path string `json:"path"`
+}
+
+// WatchConfig describes how changes in task dir reload function.
+type WatchConfig struct {
+	// Ignore lists .gitignore style patterns, in addition to defaults
+	// and .gitignore file in task dir.
+	Ignore []string `json:"ignore"`
+	// DebounceInMilliseconds delays reload until no change is seen,
+	// defaults to 200.
+	DebounceInMilliseconds int `json:"debounceInMilliseconds"`
+}
+
+// ScheduleConfig describes EventBridge schedule rule targeting function.
+type ScheduleConfig struct {
+	// Name of the rule, defaults to function name with index suffix.
+	Name string `json:"name"`
+	// ScheduleExpression is rate(value unit) or cron(fields).
+	ScheduleExpression string `json:"scheduleExpression"`
+	// Input replaces scheduled event passed to function.
+	Input json.RawMessage `json:"input,omitempty"`
+}
+
+// AsyncConfig describes retries and destinations of asynchronous
+// invocations.
+type AsyncConfig struct {
+	// MaximumRetryAttempts defaults to 2.
+	MaximumRetryAttempts *int `json:"maximumRetryAttempts"`
+	// MaximumEventAgeInSeconds defaults to 21600 (6 hours).
+	MaximumEventAgeInSeconds int `json:"maximumEventAgeInSeconds"`
+	// DestinationConfig sends invocation records to function, given by
+	// name or arn, or to a local directory.
+	DestinationConfig struct {
+		OnSuccess Destination `json:"onSuccess"`
+		OnFailure Destination `json:"onFailure"`
+	} `json:"destinationConfig"`
+}
+
+// Destination of asynchronous invocation records.
+type Destination struct {
+	Destination string `json:"destination"`
+}
+
+// WebSocketConfig describes API Gateway WebSocket API routes.
+type WebSocketConfig struct {
+	// RouteSelectionExpression selects route key from message body,
+	// defaults to "$request.body.action".
+	RouteSelectionExpression string `json:"routeSelectionExpression"`
+	// Stage name used in @connections callback urls.
+	Stage string `json:"stage"`
+	// Routes maps route keys ($connect, $disconnect, $default and custom
+	// ones) to function names.
+	Routes map[string]string `json:"routes"`
+}
+
+// QueueConfig describes local SQS queue.
+type QueueConfig struct {
+	Name string `json:"name"`
+	// VisibilityTimeout in seconds, defaults to 30.
+	VisibilityTimeout int            `json:"visibilityTimeout"`
+	RedrivePolicy     *RedrivePolicy `json:"redrivePolicy,omitempty"`
+}
+
+// RedrivePolicy moves messages received more than MaxReceiveCount times
+// to dead-letter queue, given by name or arn.
+type RedrivePolicy struct {
+	DeadLetterTargetArn string `json:"deadLetterTargetArn"`
+	MaxReceiveCount     int    `json:"maxReceiveCount"`
+}
+
+// EventSourceMapping polls queue, given by name or arn, and invokes
+// function with batches of messages.
+type EventSourceMapping struct {
+	EventSourceArn string `json:"eventSourceArn"`
+	FunctionName   string `json:"functionName"`
+	// BatchSize defaults to 10.
+	BatchSize                      int `json:"batchSize"`
+	MaximumBatchingWindowInSeconds int `json:"maximumBatchingWindowInSeconds"`
+	// FunctionResponseTypes may contain ReportBatchItemFailures.
+	FunctionResponseTypes []string `json:"functionResponseTypes"`
+}
+
+// StreamConfig describes stream event source reading records from local
+// NDJSON file or FIFO.
+type StreamConfig struct {
+	Path string `json:"path"`
+	// Type of records and event shape, kinesis (default) or dynamodb.
+	Type string `json:"type"`
+	// StreamName used in event source arn, defaults to base name of path.
+	StreamName   string `json:"streamName"`
+	FunctionName string `json:"functionName"`
+	// Shards defaults to 1.
+	Shards int `json:"shards"`
+	// BatchSize defaults to 100.
+	BatchSize int `json:"batchSize"`
+	// ParallelizationFactor defaults to 1.
+	ParallelizationFactor      int  `json:"parallelizationFactor"`
+	BisectBatchOnFunctionError bool `json:"bisectBatchOnFunctionError"`
+	// MaximumRetryAttempts defaults to -1, retry until success.
+	MaximumRetryAttempts *int `json:"maximumRetryAttempts"`
+	// Checkpoint file, defaults to path with .checkpoint suffix.
+	Checkpoint string `json:"checkpoint"`
+}
+
+// RuleConfig describes EventBridge rule matching events put on event bus.
+type RuleConfig struct {
+	Name string `json:"name"`
+	// EventBusName defaults to default.
+	EventBusName string          `json:"eventBusName"`
+	EventPattern json.RawMessage `json:"eventPattern"`
+	Targets      []*TargetConfig `json:"targets"`
+}
+
+// TargetConfig describes function target of EventBridge rule, at most one
+// of Input, InputPath and InputTransformer may be set.
+type TargetConfig struct {
+	ID string `json:"id"`
+	// Arn of function, or function name.
+	Arn              string            `json:"arn"`
+	Input            json.RawMessage   `json:"input,omitempty"`
+	InputPath        string            `json:"inputPath,omitempty"`
+	InputTransformer *InputTransformer `json:"inputTransformer,omitempty"`
+}
+
+// InputTransformer builds target input from InputTemplate with <name>
+// placeholders replaced by values selected with InputPathsMap.
+type InputTransformer struct {
+	InputPathsMap map[string]string `json:"inputPathsMap"`
+	InputTemplate string            `json:"inputTemplate"`
+}
+
+// BucketConfig maps local directory to S3 bucket, changes of files in the
+// directory send event notifications to functions.
+type BucketConfig struct {
+	Name          string                `json:"name"`
+	Path          string                `json:"path"`
+	Notifications []*NotificationConfig `json:"notifications"`
+}
+
+// NotificationConfig describes lambda function notification configuration
+// of bucket.
+type NotificationConfig struct {
+	ID           string `json:"id"`
+	FunctionName string `json:"functionName"`
+	// Events like s3:ObjectCreated:* or s3:ObjectRemoved:Delete, defaults to
+	// all created and removed events.
+	Events []string `json:"events"`
+	Filter struct {
+		Prefix string `json:"prefix"`
+		Suffix string `json:"suffix"`
+	} `json:"filter"`
+}
+
+// TopicConfig describes local SNS topic.
+type TopicConfig struct {
+	Name          string                `json:"name"`
+	Subscriptions []*SubscriptionConfig `json:"subscriptions"`
+}
+
+// SubscriptionConfig describes subscription of function or queue to topic.
+type SubscriptionConfig struct {
+	// Protocol is lambda (default) or sqs.
+	Protocol string `json:"protocol"`
+	// Endpoint is function or queue, given by name or arn.
+	Endpoint string `json:"endpoint"`
+	// FilterPolicy uses event pattern syntax to match message attributes
+	// or message body, depending on FilterPolicyScope.
+	FilterPolicy json.RawMessage `json:"filterPolicy,omitempty"`
+	// FilterPolicyScope is MessageAttributes (default) or MessageBody.
+	FilterPolicyScope string `json:"filterPolicyScope"`
+	// RawMessageDelivery sends message body without SNS envelope to
+	// queues.
+	RawMessageDelivery bool `json:"rawMessageDelivery"`
+}
+
+// loadConfig reads config file, relative task dirs are resolved against
+// directory of the config file.
+func loadConfig(name string) (*Config, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(Config)
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	if len(config.Functions) == 0 {
+		return nil, errors.New("config: no functions defined")
+	}
+
+	base := filepath.Dir(name)
+	for _, fc := range config.Functions {
+		if fc.Task != "" && !filepath.IsAbs(fc.Task) {
+			fc.Task = filepath.Join(base, fc.Task)
+		}
+		if fc.Zip != "" && !filepath.IsAbs(fc.Zip) {
+			fc.Zip = filepath.Join(base, fc.Zip)
+		}
+		if f := fc.Environment.EnvFile; f != "" && !filepath.IsAbs(f) {
+			fc.Environment.EnvFile = filepath.Join(base, f)
+		}
+		for i, layer := range fc.Layers {
+			if !filepath.IsAbs(layer) {
+				fc.Layers[i] = filepath.Join(base, layer)
+			}
+		}
+		if p := fc.Cassette.Path; p != "" && !filepath.IsAbs(p) {
+			fc.Cassette.Path = filepath.Join(base, p)
+		}
+	}
+	for _, sc := range config.Streams {
+		if sc.Path != "" && !filepath.IsAbs(sc.Path) {
+			sc.Path = filepath.Join(base, sc.Path)
+		}
+		if sc.Checkpoint != "" && !filepath.IsAbs(sc.Checkpoint) {
+			sc.Checkpoint = filepath.Join(base, sc.Checkpoint)
+		}
+	}
+	for _, bc := range config.Buckets {
+		// bucket dir is named after bucket by default
+		if bc.Path == "" {
+			bc.Path = bc.Name
+		}
+		if !filepath.IsAbs(bc.Path) {
+			bc.Path = filepath.Join(base, bc.Path)
+		}
+	}
+
+	return config, nil
+}
+
+// setDefaults fills function config fields not set in config file with
+// values from command line flags.
+func (c *Config) setDefaults() {
+	for _, fc := range c.Functions {
+		if fc.Runtime == "" {
+			fc.Runtime = *executionEnv
+		}
+		if fc.Handler == "" {
+			fc.Handler = *handler
+		}
+		if fc.Task == "" && fc.Zip == "" {
+			fc.Task = *task
+		}
+		if fc.Zip == "" && strings.HasSuffix(fc.Task, ".zip") {
+			fc.Zip, fc.Task = fc.Task, ""
+		}
+		if fc.Task == "" {
+			fc.Task = filepath.Dir(fc.Zip)
+		}
+		if fc.MemorySize == 0 {
+			fc.MemorySize = 128
+		}
+		if fc.IdleTimeoutInSeconds == 0 {
+			fc.IdleTimeoutInSeconds = int(idleTimeout.Seconds())
+		}
+		if fc.MaxLifetimeInSeconds == 0 {
+			fc.MaxLifetimeInSeconds = int(maxLifetime.Seconds())
+		}
+		if fc.MaxInvocations == 0 {
+			fc.MaxInvocations = *maxInvocations
+		}
+		if fc.Environment.EnvFile == "" {
+			fc.Environment.EnvFile = *envFile
+		}
+		if fc.Cassette.Mode == "" {
+			fc.Cassette.Mode = *cassetteMode
+		}
+		if fc.Cassette.Path == "" {
+			fc.Cassette.Path = filepath.Join(*cassetteDir, fc.Name+".json")
+		}
+		if fc.Network.Offline || len(fc.Network.Egress) > 0 {
+			fc.Network.Isolated = true
+		}
+		if fc.Watch.DebounceInMilliseconds == 0 {
+			fc.Watch.DebounceInMilliseconds = 200
+		}
+		for i, sc := range fc.Schedules {
+			if sc.Name == "" {
+				sc.Name = fmt.Sprintf("%s-schedule-%d", fc.Name, i)
+			}
+		}
+		if fc.Async.MaximumRetryAttempts == nil {
+			attempts := 2
+			fc.Async.MaximumRetryAttempts = &attempts
+		}
+		if fc.Async.MaximumEventAgeInSeconds == 0 {
+			fc.Async.MaximumEventAgeInSeconds = 21600
+		}
+	}
+	for _, qc := range c.Queues {
+		if qc.VisibilityTimeout == 0 {
+			qc.VisibilityTimeout = 30
+		}
+	}
+	for _, esm := range c.EventSourceMappings {
+		if esm.BatchSize == 0 {
+			esm.BatchSize = 10
+		}
+	}
+	for _, sc := range c.Streams {
+		if sc.Type == "" {
+			sc.Type = "kinesis"
+		}
+		if sc.StreamName == "" {
+			sc.StreamName = strings.TrimSuffix(filepath.Base(sc.Path), filepath.Ext(sc.Path))
+		}
+		if sc.Shards == 0 {
+			sc.Shards = 1
+		}
+		if sc.BatchSize == 0 {
+			sc.BatchSize = 100
+		}
+		if sc.ParallelizationFactor == 0 {
+			sc.ParallelizationFactor = 1
+		}
+		if sc.MaximumRetryAttempts == nil {
+			attempts := -1
+			sc.MaximumRetryAttempts = &attempts
+		}
+		if sc.Checkpoint == "" {
+			sc.Checkpoint = sc.Path + ".checkpoint"
+		}
+	}
+	for _, rc := range c.Rules {
+		if rc.EventBusName == "" {
+			rc.EventBusName = "default"
+		}
+	}
+	for _, bc := range c.Buckets {
+		for i, nc := range bc.Notifications {
+			if nc.ID == "" {
+				nc.ID = fmt.Sprintf("%s-notification-%d", bc.Name, i)
+			}
+			if len(nc.Events) == 0 {
+				nc.Events = []string{"s3:ObjectCreated:*", "s3:ObjectRemoved:*"}
+			}
+		}
+	}
+	for _, tc := range c.Topics {
+		for _, sc := range tc.Subscriptions {
+			if sc.Protocol == "" {
+				sc.Protocol = "lambda"
+			}
+			if sc.FilterPolicyScope == "" {
+				sc.FilterPolicyScope = "MessageAttributes"
+			}
+		}
+	}
+	if ws := c.WebSocket; ws != nil {
+		if ws.RouteSelectionExpression == "" {
+			ws.RouteSelectionExpression = "$request.body.action"
+		}
+		if ws.Stage == "" {
+			ws.Stage = "local"
+		}
+	}
+}
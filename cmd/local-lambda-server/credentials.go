@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dzeromsk/subslicer"
+)
+
+// awsCredentials are AWS credentials, Expiration is zero for long-term
+// ones.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+// credentialSource retrieves credentials.
+type credentialSource func() (*awsCredentials, error)
+
+// refreshWindow is how long before expiry credentials are refreshed.
+const refreshWindow = 5 * time.Minute
+
+// cachedCredentials caches credentials of source until they are about to
+// expire.
+type cachedCredentials struct {
+	source credentialSource
+
+	m     sync.Mutex
+	creds *awsCredentials
+	// failed retrieval is retried after a while and logged once
+	err     error
+	retryAt time.Time
+}
+
+func newCachedCredentials(source credentialSource) *cachedCredentials {
+	return &cachedCredentials{source: source}
+}
+
+func (c *cachedCredentials) Get() (*awsCredentials, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.creds != nil && (c.creds.Expiration.IsZero() || time.Until(c.creds.Expiration) > refreshWindow) {
+		return c.creds, nil
+	}
+	if c.err != nil && time.Now().Before(c.retryAt) {
+		return c.valid()
+	}
+
+	creds, err := c.source()
+	if err != nil {
+		if c.err == nil || c.err.Error() != err.Error() {
+			log.Println("credentials:", err)
+		}
+		c.err = err
+		c.retryAt = time.Now().Add(time.Minute)
+		return c.valid()
+	}
+	c.creds, c.err = creds, nil
+	return creds, nil
+}
+
+// valid returns cached credentials that are not expired yet, or the last
+// error.
+func (c *cachedCredentials) valid() (*awsCredentials, error) {
+	if c.creds != nil && time.Now().Before(c.creds.Expiration) {
+		return c.creds, nil
+	}
+	return nil, c.err
+}
+
+// Subslicer returns credentials passed to function instances, without
+// credentials instances get none.
+func (c *cachedCredentials) Subslicer() subslicer.Credentials {
+	creds, err := c.Get()
+	if err != nil {
+		return subslicer.Credentials{}
+	}
+	return subslicer.Credentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+	}
+}
+
+// hostCredentials resolves credentials of the host like AWS SDKs do, from
+// environment variables or shared config profile.
+func hostCredentials(profile string) credentialSource {
+	return func() (*awsCredentials, error) {
+		if creds := envCredentials(); creds != nil && profile == "" {
+			return creds, nil
+		}
+		name := profile
+		if name == "" {
+			name = os.Getenv("AWS_PROFILE")
+		}
+		if name == "" {
+			name = "default"
+		}
+		return profileCredentials(name, 0)
+	}
+}
+
+func envCredentials() *awsCredentials {
+	id := os.Getenv("AWS_ACCESS_KEY_ID")
+	if id == "" {
+		return nil
+	}
+	return &awsCredentials{
+		AccessKeyID:     id,
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// profileCredentials resolves profile from shared credentials and config
+// files, profiles with role_arn assume role with source_profile
+// credentials.
+func profileCredentials(name string, depth int) (*awsCredentials, error) {
+	if depth > 4 {
+		return nil, fmt.Errorf("profile %s: source_profile chain too long", name)
+	}
+
+	home := homedir()
+	credentialsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		credentialsFile = filepath.Join(home, ".aws", "credentials")
+	}
+	configFile := os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = filepath.Join(home, ".aws", "config")
+	}
+
+	p := make(map[string]string)
+	configSection := "profile " + name
+	if name == "default" {
+		configSection = name
+	}
+	for k, v := range readINI(configFile)[configSection] {
+		p[k] = v
+	}
+	for k, v := range readINI(credentialsFile)[name] {
+		p[k] = v
+	}
+	if len(p) == 0 {
+		return nil, fmt.Errorf("profile %s: not found", name)
+	}
+
+	if roleArn := p["role_arn"]; roleArn != "" {
+		var base *awsCredentials
+		var err error
+		switch {
+		case p["source_profile"] != "" && p["source_profile"] != name:
+			base, err = profileCredentials(p["source_profile"], depth+1)
+		case p["source_profile"] == name:
+			base = staticProfileCredentials(p)
+		case p["credential_source"] == "Environment":
+			if base = envCredentials(); base == nil {
+				err = fmt.Errorf("profile %s: no credentials in environment", name)
+			}
+		default:
+			err = fmt.Errorf("profile %s: role_arn without source_profile is not supported", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		session := p["role_session_name"]
+		if session == "" {
+			session = fmt.Sprintf("local-lambda-server-%d", time.Now().Unix())
+		}
+		return assumeRole(base, roleArn, session, p["external_id"])
+	}
+
+	if p["aws_access_key_id"] == "" {
+		return nil, fmt.Errorf("profile %s: no credentials", name)
+	}
+	return staticProfileCredentials(p), nil
+}
+
+func staticProfileCredentials(p map[string]string) *awsCredentials {
+	return &awsCredentials{
+		AccessKeyID:     p["aws_access_key_id"],
+		SecretAccessKey: p["aws_secret_access_key"],
+		SessionToken:    p["aws_session_token"],
+	}
+}
+
+// readINI returns sections of ini file, missing file has none.
+func readINI(name string) map[string]map[string]string {
+	sections := make(map[string]map[string]string)
+	f, err := os.Open(name)
+	if err != nil {
+		return sections
+	}
+	defer f.Close()
+
+	var section map[string]string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			section = make(map[string]string)
+			sections[name] = section
+		case section != nil:
+			if i := strings.IndexByte(line, '='); i > 0 {
+				section[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+	return sections
+}
+
+// assumeRoleSource returns source assuming role with credentials of base.
+func assumeRoleSource(base *cachedCredentials, roleArn, session string) credentialSource {
+	return func() (*awsCredentials, error) {
+		creds, err := base.Get()
+		if err != nil {
+			return nil, err
+		}
+		return assumeRole(creds, roleArn, session, "")
+	}
+}
+
+// assumeRole calls STS AssumeRole on -sts-endpoint.
+func assumeRole(creds *awsCredentials, roleArn, session, externalID string) (*awsCredentials, error) {
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {roleArn},
+		"RoleSessionName": {session},
+		"DurationSeconds": {"3600"},
+	}
+	if externalID != "" {
+		form.Set("ExternalId", externalID)
+	}
+	body := []byte(form.Encode())
+
+	endpoint := *stsEndpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com", *region)
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signV4(req, body, creds, *region, "sts", time.Now())
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error struct {
+				Code    string
+				Message string
+			}
+		}
+		xml.Unmarshal(data, &e)
+		return nil, fmt.Errorf("assume role %s: %s: %s %s", roleArn, resp.Status, e.Error.Code, e.Error.Message)
+	}
+
+	var r struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleResult>Credentials"`
+	}
+	if err := xml.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	if r.Credentials.AccessKeyId == "" {
+		return nil, errors.New("assume role: no credentials in response")
+	}
+	log.Println("credentials: assumed role", roleArn, "until", r.Credentials.Expiration.Format(time.RFC3339))
+	return &awsCredentials{
+		AccessKeyID:     r.Credentials.AccessKeyId,
+		SecretAccessKey: r.Credentials.SecretAccessKey,
+		SessionToken:    r.Credentials.SessionToken,
+		Expiration:      r.Credentials.Expiration,
+	}, nil
+}
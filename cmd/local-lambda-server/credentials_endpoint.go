@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// roleMapping describes credentials served to function by credentials
+// endpoint, role assumed with host credentials, shared config profile or
+// static keys.
+type roleMapping struct {
+	RoleArn         string `json:"roleArn"`
+	Profile         string `json:"profile"`
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	SessionToken    string `json:"sessionToken"`
+}
+
+// credentialsServer is container credentials endpoint, like the one of
+// ECS tasks. Each function gets its own authorization token, so functions
+// get only credentials meant for them.
+type credentialsServer struct {
+	url     string
+	mapping map[string]*roleMapping
+	host    *cachedCredentials
+	tokens  map[string]*credentialsFunction
+}
+
+type credentialsFunction struct {
+	name  string
+	creds *cachedCredentials
+}
+
+// newCredentialsServer reads role mapping file, a json object of function
+// names and their credentials.
+func newCredentialsServer(url, mappingFile string) (*credentialsServer, error) {
+	s := &credentialsServer{
+		url:     url,
+		mapping: make(map[string]*roleMapping),
+		host:    newCachedCredentials(hostCredentials(*profile)),
+		tokens:  make(map[string]*credentialsFunction),
+	}
+	if mappingFile != "" {
+		data, err := ioutil.ReadFile(mappingFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &s.mapping); err != nil {
+			return nil, fmt.Errorf("%s: %v", mappingFile, err)
+		}
+	}
+	return s, nil
+}
+
+// Register makes function get credentials from endpoint instead of keys
+// passed at start and with invocations. Functions without mapping get
+// credentials of their execution role, or host credentials, as before.
+func (s *credentialsServer) Register(fn *function) error {
+	creds := fn.creds
+	if m, ok := s.mapping[fn.Name]; ok {
+		source, err := m.source(s.host, fn.Name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fn.Name, err)
+		}
+		creds = newCachedCredentials(source)
+	}
+
+	var b [16]byte
+	rand.Read(b[:])
+	token := hex.EncodeToString(b[:])
+	s.tokens[token] = &credentialsFunction{name: fn.Name, creds: creds}
+
+	fn.runtime.Credentials = nil
+	fn.env["AWS_CONTAINER_CREDENTIALS_FULL_URI"] = s.url
+	fn.env["AWS_CONTAINER_AUTHORIZATION_TOKEN"] = token
+	fn.runtime.Env = envList(fn.env)
+	return nil
+}
+
+func (m *roleMapping) source(host *cachedCredentials, name string) (credentialSource, error) {
+	switch {
+	case m.RoleArn != "":
+		return assumeRoleSource(host, m.RoleArn, "local-lambda-server-"+name), nil
+	case m.Profile != "":
+		return hostCredentials(m.Profile), nil
+	case m.AccessKeyID != "":
+		creds := &awsCredentials{
+			AccessKeyID:     m.AccessKeyID,
+			SecretAccessKey: m.SecretAccessKey,
+			SessionToken:    m.SessionToken,
+		}
+		return func() (*awsCredentials, error) { return creds, nil }, nil
+	}
+	return nil, errors.New("role mapping needs roleArn, profile or accessKeyId")
+}
+
+func (s *credentialsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	writeError := func(status int, code, message string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"code": code, "message": message})
+	}
+
+	if r.Method != http.MethodGet {
+		writeError(http.StatusMethodNotAllowed, "MethodNotAllowed", "Only GET is supported")
+		return
+	}
+	f, ok := s.tokens[r.Header.Get("Authorization")]
+	if !ok {
+		writeError(http.StatusUnauthorized, "AccessDenied", "Invalid authorization token")
+		return
+	}
+	creds, err := f.creds.Get()
+	if err != nil {
+		writeError(http.StatusInternalServerError, "CredentialsError", err.Error())
+		log.Println("credentials:", f.name, err)
+		return
+	}
+
+	// SDKs require expiration, long-term keys are served as if they
+	// were temporary
+	expiration := creds.Expiration
+	if expiration.IsZero() {
+		expiration = time.Now().Add(time.Hour)
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"AccessKeyId":     creds.AccessKeyID,
+		"SecretAccessKey": creds.SecretAccessKey,
+		"Token":           creds.SessionToken,
+		"Expiration":      expiration.UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// endpointEnv returns AWS_ENDPOINT_URL variables of endpoint urls, service
+// ids are upper cased with spaces and dashes replaced like SDKs do.
+func endpointEnv(urls map[string]string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for service, endpoint := range urls {
+		if u, err := url.Parse(endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint url of %s: %s", service, endpoint)
+		}
+		if service == "default" {
+			vars["AWS_ENDPOINT_URL"] = endpoint
+			continue
+		}
+		key := strings.ToUpper(strings.NewReplacer(" ", "_", "-", "_").Replace(service))
+		vars["AWS_ENDPOINT_URL_"+key] = endpoint
+	}
+	return vars, nil
+}
+
+// writeHosts writes /etc/hosts of function sandbox, localhost entries
+// are always present.
+func writeHosts(name string, hosts map[string]string) (string, error) {
+	var names []string
+	for host, addr := range hosts {
+		if net.ParseIP(addr) == nil {
+			return "", fmt.Errorf("invalid address of host %s: %s", host, addr)
+		}
+		names = append(names, host)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("127.0.0.1\tlocalhost\n")
+	b.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	for _, host := range names {
+		fmt.Fprintf(&b, "%s\t%s\n", hosts[host], host)
+	}
+
+	dir := filepath.Join(os.TempDir(), "local-lambda-server", "hosts")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	// sandbox user must be able to read it
+	if err := ioutil.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
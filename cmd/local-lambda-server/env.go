@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxEnvSize is lambda limit of total size of environment variables.
+const maxEnvSize = 4096
+
+// reservedEnv are variables set by lambda runtime that functions can not
+// override.
+var reservedEnv = map[string]bool{
+	"_HANDLER":                        true,
+	"_X_AMZN_TRACE_ID":                true,
+	"AWS_DEFAULT_REGION":              true,
+	"AWS_REGION":                      true,
+	"AWS_EXECUTION_ENV":               true,
+	"AWS_LAMBDA_FUNCTION_NAME":        true,
+	"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": true,
+	"AWS_LAMBDA_FUNCTION_VERSION":     true,
+	"AWS_LAMBDA_INITIALIZATION_TYPE":  true,
+	"AWS_LAMBDA_LOG_GROUP_NAME":       true,
+	"AWS_LAMBDA_LOG_STREAM_NAME":      true,
+	"AWS_ACCESS_KEY":                  true,
+	"AWS_ACCESS_KEY_ID":               true,
+	"AWS_SECRET_ACCESS_KEY":           true,
+	"AWS_SESSION_TOKEN":               true,
+	"AWS_LAMBDA_RUNTIME_API":          true,
+	"LAMBDA_TASK_ROOT":                true,
+	"LAMBDA_RUNTIME_DIR":              true,
+}
+
+var envKey = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+
+// loadEnvFile reads KEY=value lines, blank lines and # comments are
+// skipped, values may be quoted and lines may start with export.
+func loadEnvFile(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vars := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.IndexByte(line, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: invalid line", name, n)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch {
+		case strings.HasPrefix(value, `"`):
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", name, n, err)
+			}
+		case strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") && len(value) > 1:
+			value = value[1 : len(value)-1]
+		}
+		vars[key] = value
+	}
+	return vars, s.Err()
+}
+
+// validateEnv checks variables against lambda naming rules, reserved
+// keys and total size limit.
+func validateEnv(vars map[string]string) error {
+	size := 0
+	for key, value := range vars {
+		if !envKey.MatchString(key) {
+			return fmt.Errorf("invalid environment variable name: %s", key)
+		}
+		if reservedEnv[key] || strings.HasPrefix(key, "_LAMBDA_") {
+			return fmt.Errorf("reserved environment variable: %s", key)
+		}
+		size += len(key) + len(value)
+	}
+	if size > maxEnvSize {
+		return fmt.Errorf("environment variables size %d exceeds limit of %d bytes", size, maxEnvSize)
+	}
+	return nil
+}
+
+// envList returns variables in KEY=value form sorted by key.
+func envList(vars map[string]string) []string {
+	var env []string
+	for key, value := range vars {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// functionEnv returns variables of function, ones from config override
+// ones from env file, which override endpoint urls. Only variables of
+// user count towards lambda limits.
+func functionEnv(fc *FunctionConfig) (map[string]string, error) {
+	user := make(map[string]string)
+	if fc.Environment.EnvFile != "" {
+		file, err := loadEnvFile(fc.Environment.EnvFile)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range file {
+			user[k] = v
+		}
+	}
+	for k, v := range fc.Environment.Variables {
+		user[k] = v
+	}
+	if err := validateEnv(user); err != nil {
+		return nil, err
+	}
+
+	vars, err := endpointEnv(fc.Endpoints.URLs)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range user {
+		vars[k] = v
+	}
+	return vars, nil
+}
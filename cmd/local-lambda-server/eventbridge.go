@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// eventRule is EventBridge rule with parsed event pattern.
+type eventRule struct {
+	*RuleConfig
+	pattern eventPattern
+}
+
+// eventBus routes events put with PutEvents to targets of matching rules.
+// Targets are invoked asynchronously.
+type eventBus struct {
+	reg   *registry
+	queue *asyncQueue
+	rules []*eventRule
+}
+
+func newEventBus(reg *registry, queue *asyncQueue, configs []*RuleConfig) (*eventBus, error) {
+	b := &eventBus{reg: reg, queue: queue}
+	for _, rc := range configs {
+		pattern, err := parseEventPattern(rc.EventPattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", rc.Name, err)
+		}
+		for _, t := range rc.Targets {
+			if _, ok := reg.Lookup(t.Arn); !ok {
+				return nil, fmt.Errorf("rule %s: unknown function target: %s", rc.Name, t.Arn)
+			}
+			if t.InputPath != "" && !strings.HasPrefix(t.InputPath, "$") {
+				return nil, fmt.Errorf("rule %s: invalid input path: %s", rc.Name, t.InputPath)
+			}
+		}
+		b.rules = append(b.rules, &eventRule{RuleConfig: rc, pattern: pattern})
+	}
+	return b, nil
+}
+
+// Put sends event to targets of rules on event bus matching the event,
+// trace is X-Amzn-Trace-Id of sender.
+func (b *eventBus) Put(busName string, event map[string]interface{}, trace string) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("events:", err)
+		return
+	}
+
+	for _, r := range b.rules {
+		if r.EventBusName != busName || !r.pattern.Match(event) {
+			continue
+		}
+		for _, t := range r.Targets {
+			input, err := targetInput(r, t, event, data)
+			if err != nil {
+				log.Println("events:", r.Name, t.ID, err)
+				continue
+			}
+			fn, _ := b.reg.Lookup(t.Arn)
+			if _, err := b.queue.Enqueue(fn.Name, input, trace); err != nil {
+				log.Println("events:", err)
+			}
+		}
+	}
+}
+
+// targetInput returns event transformed as configured for the target.
+func targetInput(r *eventRule, t *TargetConfig, event map[string]interface{}, data []byte) ([]byte, error) {
+	switch {
+	case len(t.Input) > 0:
+		return t.Input, nil
+
+	case t.InputPath != "":
+		return json.Marshal(jsonPath(event, t.InputPath))
+
+	case t.InputTransformer != nil:
+		values := map[string]interface{}{
+			"aws.events.rule-name":            r.Name,
+			"aws.events.event":                json.RawMessage(data),
+			"aws.events.event.ingestion-time": event["time"],
+		}
+		for name, path := range t.InputTransformer.InputPathsMap {
+			values[name] = jsonPath(event, path)
+		}
+		return transformInput(t.InputTransformer.InputTemplate, values)
+	}
+	return data, nil
+}
+
+// jsonPath selects value with simple $.a.b path, nil when not found.
+func jsonPath(v interface{}, path string) interface{} {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return v
+	}
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+// transformInput replaces <name> placeholders in template. Strings inside
+// quoted template strings are inserted without quotes, other values are
+// inserted as json.
+func transformInput(template string, values map[string]interface{}) ([]byte, error) {
+	var out strings.Builder
+	inString := false
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		switch {
+		case c == '\\' && inString && i+1 < len(template):
+			out.WriteByte(c)
+			i++
+			out.WriteByte(template[i])
+			continue
+		case c == '"':
+			inString = !inString
+		case c == '<':
+			end := strings.IndexByte(template[i:], '>')
+			if end < 0 {
+				break
+			}
+			name := template[i+1 : i+end]
+			v, ok := values[name]
+			if !ok {
+				break
+			}
+			if s, ok := v.(string); ok && inString {
+				// escape as json string without surrounding quotes
+				q, _ := json.Marshal(s)
+				out.Write(q[1 : len(q)-1])
+			} else {
+				q, err := json.Marshal(v)
+				if err != nil {
+					return nil, err
+				}
+				out.Write(q)
+			}
+			i += end
+			continue
+		}
+		out.WriteByte(c)
+	}
+	return []byte(out.String()), nil
+}
+
+// ServeHTTP serves PutEvents using json protocol
+// (X-Amz-Target: AWSEvents.PutEvents).
+func (b *eventBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+
+	if r.Header.Get("X-Amz-Target") != "AWSEvents.PutEvents" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"__type":  "UnknownOperationException",
+			"message": "Only PutEvents is supported",
+		})
+		return
+	}
+
+	var req struct {
+		Entries []struct {
+			Source       string
+			DetailType   string
+			Detail       string
+			Resources    []string
+			Time         *float64
+			EventBusName string
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"__type":  "ValidationException",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	type resultEntry struct {
+		EventID      string `json:"EventId,omitempty"`
+		ErrorCode    string `json:"ErrorCode,omitempty"`
+		ErrorMessage string `json:"ErrorMessage,omitempty"`
+	}
+	var resp struct {
+		FailedEntryCount int
+		Entries          []resultEntry
+	}
+
+	for _, e := range req.Entries {
+		event, err := newBusEvent(e.Source, e.DetailType, e.Detail, e.Resources, e.Time)
+		if err != nil {
+			resp.FailedEntryCount++
+			resp.Entries = append(resp.Entries, resultEntry{
+				ErrorCode:    "MalformedDetail",
+				ErrorMessage: err.Error(),
+			})
+			continue
+		}
+
+		busName := e.EventBusName
+		if i := strings.LastIndexAny(busName, ":/"); i >= 0 {
+			busName = busName[i+1:]
+		}
+		if busName == "" {
+			busName = "default"
+		}
+
+		b.Put(busName, event, r.Header.Get("X-Amzn-Trace-Id"))
+		resp.Entries = append(resp.Entries, resultEntry{EventID: event["id"].(string)})
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
+
+func newBusEvent(source, detailType, detail string, resources []string, t *float64) (map[string]interface{}, error) {
+	if source == "" || detailType == "" || detail == "" {
+		return nil, errors.New("Source, DetailType and Detail are required")
+	}
+	var d map[string]interface{}
+	if err := json.Unmarshal([]byte(detail), &d); err != nil {
+		return nil, errors.New("Detail is malformed")
+	}
+	if resources == nil {
+		resources = []string{}
+	}
+	when := time.Now()
+	if t != nil {
+		when = time.Unix(int64(*t), 0)
+	}
+	return map[string]interface{}{
+		"version":     "0",
+		"id":          requestID(),
+		"detail-type": detailType,
+		"source":      source,
+		"account":     accountID,
+		"time":        when.UTC().Format(time.RFC3339),
+		"region":      *region,
+		"resources":   toInterfaces(resources),
+		"detail":      d,
+	}, nil
+}
+
+// toInterfaces converts strings so patterns match them like decoded json.
+func toInterfaces(s []string) []interface{} {
+	v := make([]interface{}, len(s))
+	for i := range s {
+		v[i] = s[i]
+	}
+	return v
+}
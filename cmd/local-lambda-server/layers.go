@@ -0,0 +1,320 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Lambda limits of layers, unzipped size includes function code.
+const (
+	maxLayers       = 5
+	maxUnzippedSize = 262144000
+)
+
+// buildLayers merges layers of function, dirs or zip files, in order into
+// read-only tree mounted at /opt. Trees are cached by layer contents.
+func buildLayers(fc *FunctionConfig) (string, error) {
+	if len(fc.Layers) > maxLayers {
+		return "", fmt.Errorf("too many layers: %d, limit is %d", len(fc.Layers), maxLayers)
+	}
+
+	h := sha256.New()
+	for _, layer := range fc.Layers {
+		if err := hashLayer(h, layer); err != nil {
+			return "", err
+		}
+	}
+	cache, err := cacheDir("layers")
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(cache, hex.EncodeToString(h.Sum(nil))[:16])
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		tmp, err := ioutil.TempDir(cache, "tmp")
+		if err != nil {
+			return "", err
+		}
+		for _, layer := range fc.Layers {
+			if err := extractLayer(layer, tmp); err != nil {
+				os.RemoveAll(tmp)
+				return "", fmt.Errorf("layer %s: %v", layer, err)
+			}
+		}
+		// sandbox user must be able to read the tree
+		os.Chmod(tmp, 0755)
+		if err := os.Rename(tmp, dir); err != nil {
+			// built concurrently by other server
+			os.RemoveAll(tmp)
+		}
+	}
+	return dir, nil
+}
+
+// checkSize checks that code dir and merged layers fit in unzipped size
+// limit.
+func checkSize(fc *FunctionConfig, code, opt string) error {
+	size, err := treeSize(opt, nil)
+	if err != nil {
+		return err
+	}
+	var ignore ignoreRules
+	if fc.Zip == "" {
+		ignore = taskIgnore(fc)
+	}
+	codeSize, err := treeSize(code, ignore)
+	if err != nil {
+		return err
+	}
+	if size+codeSize > maxUnzippedSize {
+		return fmt.Errorf("unzipped size of function and layers %d must be smaller than %d bytes", size+codeSize, maxUnzippedSize)
+	}
+	return nil
+}
+
+// cacheDir returns dir of unpacked trees of kind. Trees are mounted into
+// sandboxes, so cache lives in dir private to user running server.
+func cacheDir(kind string) (string, error) {
+	base := filepath.Join(os.TempDir(), fmt.Sprintf("local-lambda-server-%d", os.Getuid()))
+	if err := os.Mkdir(base, 0700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	info, err := os.Lstat(base)
+	if err != nil {
+		return "", err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(st.Uid) != os.Getuid() || info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("cache dir %s must be owned by uid %d with mode 0700", base, os.Getuid())
+	}
+	dir := filepath.Join(base, kind)
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// hashLayer writes names, modes and contents of layer files to h.
+func hashLayer(h io.Writer, layer string) error {
+	fmt.Fprintln(h, layer)
+	return filepath.Walk(layer, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(h, name, info.Mode(), info.Size())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(h, link)
+		case info.Mode().IsRegular():
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(h, f)
+			return err
+		}
+		return nil
+	})
+}
+
+// extractLayer copies layer dir or unpacks layer zip into dst, files of
+// earlier layers are overwritten.
+func extractLayer(layer, dst string) error {
+	info, err := os.Stat(layer)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return copyTree(layer, dst)
+	}
+	return unzip(layer, dst, maxUnzippedSize)
+}
+
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, 0755)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(name)
+			if err != nil {
+				return err
+			}
+			os.Remove(target)
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return writeFile(target, f, info.Mode())
+		}
+		return nil
+	})
+}
+
+// unzip unpacks zip into dst. Entries can't escape dst, neither by name
+// nor through symlinks unpacked earlier, and unpack at most limit bytes as
+// sizes in zip headers may lie.
+func unzip(name, dst string, limit int64) error {
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dst = filepath.Clean(dst)
+	max := limit
+	for _, f := range r.File {
+		target := filepath.Join(dst, f.Name)
+		if !within(dst, target) {
+			return fmt.Errorf("invalid file name in zip: %s", f.Name)
+		}
+
+		mode := f.Mode()
+		parent := filepath.Dir(target)
+		if mode.IsDir() {
+			parent = target
+		}
+		if err := throughSymlink(dst, parent); err != nil {
+			return err
+		}
+		if mode.IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		if mode&os.ModeSymlink != 0 {
+			link, err := ioutil.ReadAll(io.LimitReader(rc, limit+1))
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			if limit -= int64(len(link)); limit < 0 {
+				return fmt.Errorf("unzipped size must be smaller than %d bytes", max)
+			}
+			if filepath.IsAbs(string(link)) || !within(dst, filepath.Join(parent, string(link))) {
+				return fmt.Errorf("symlink %s points outside of zip: %s", f.Name, link)
+			}
+			os.Remove(target)
+			if err := os.Symlink(string(link), target); err != nil {
+				return err
+			}
+			continue
+		}
+		// zips made on windows have no permissions
+		if mode.Perm() == 0 {
+			mode = 0644
+		}
+		lr := &io.LimitedReader{R: rc, N: limit + 1}
+		err = writeFile(target, lr, mode)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if limit = lr.N - 1; limit < 0 {
+			return fmt.Errorf("unzipped size must be smaller than %d bytes", max)
+		}
+	}
+	return nil
+}
+
+// within reports whether name is dst or below it, both must be clean.
+func within(dst, name string) bool {
+	return name == dst || strings.HasPrefix(name, dst+string(filepath.Separator))
+}
+
+// throughSymlink returns error if existing part of dir below dst is
+// symlink.
+func throughSymlink(dst, dir string) error {
+	rel, err := filepath.Rel(dst, dir)
+	if err != nil || rel == "." {
+		return err
+	}
+	p := dst
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, part)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("path in zip goes through symlink: %s", rel)
+		}
+	}
+	return nil
+}
+
+// writeFile replaces file with contents of r, files are readable by
+// sandbox user.
+func writeFile(name string, r io.Reader, mode os.FileMode) error {
+	os.Remove(name)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()|0444)
+	if err != nil {
+		return err
+	}
+	// not masked by umask
+	if err := f.Chmod(mode.Perm() | 0444); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// treeSize returns total size of regular files in dir, skipping ignored
+// ones.
+func treeSize(dir string, ignore ignoreRules) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if rel, _ := filepath.Rel(dir, name); rel != "." && ignore.Match(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
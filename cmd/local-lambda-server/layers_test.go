@@ -0,0 +1,170 @@
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type zipEntry struct {
+	name, body string
+	mode       os.FileMode
+}
+
+func writeZip(t *testing.T, name string, entries []zipEntry) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		h.SetMode(e.mode)
+		fw, err := w.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnzip(t *testing.T) {
+	const link = os.ModeSymlink | 0777
+	tests := []struct {
+		name    string
+		entries []zipEntry
+		limit   int64
+		err     string
+	}{
+		{"benign", []zipEntry{
+			{"a/", "", os.ModeDir | 0755},
+			{"a/b.txt", "hello", 0644},
+			{"link", "a/b.txt", link},
+			{"a/up", "../link", link},
+		}, 100, ""},
+		{"dot dot name", []zipEntry{
+			{"../evil", "x", 0644},
+		}, 100, "invalid file name"},
+		{"nested dot dot name", []zipEntry{
+			{"a/../../evil", "x", 0644},
+		}, 100, "invalid file name"},
+		{"absolute symlink", []zipEntry{
+			{"a", "/tmp", link},
+			{"a/evil", "x", 0644},
+		}, 100, "points outside"},
+		{"relative symlink outside", []zipEntry{
+			{"a", "../..", link},
+		}, 100, "points outside"},
+		{"write through symlink", []zipEntry{
+			{"sub/", "", os.ModeDir | 0755},
+			{"a", "sub", link},
+			{"a/evil", "x", 0644},
+		}, 100, "through symlink"},
+		{"chained symlink", []zipEntry{
+			{"x/y", "..", link},
+			{"x/y/z", "..", link},
+		}, 100, "through symlink"},
+		{"dir through symlink", []zipEntry{
+			{"sub/", "", os.ModeDir | 0755},
+			{"a", "sub", link},
+			{"a/dir/", "", os.ModeDir | 0755},
+		}, 100, "through symlink"},
+		{"size at limit", []zipEntry{
+			{"a", strings.Repeat("x", 60), 0644},
+			{"b", strings.Repeat("x", 40), 0644},
+		}, 100, ""},
+		{"size over limit", []zipEntry{
+			{"a", strings.Repeat("x", 60), 0644},
+			{"b", strings.Repeat("x", 41), 0644},
+		}, 100, "must be smaller"},
+		{"symlink over limit", []zipEntry{
+			{"a", strings.Repeat("x", 98), 0644},
+			{"b", "a/b", link},
+		}, 100, "must be smaller"},
+	}
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "unzip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Join(dir, "code.zip")
+		writeZip(t, name, tt.entries)
+		dst := filepath.Join(dir, "out", "task")
+
+		err = unzip(name, dst, tt.limit)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		case tt.err != "" && err == nil:
+			t.Errorf("%s: expected error %q", tt.name, tt.err)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+		}
+		for _, evil := range []string{"evil", "out/evil"} {
+			if _, err := os.Lstat(filepath.Join(dir, evil)); err == nil {
+				t.Errorf("%s: %s written outside of destination", tt.name, evil)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUnzipContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "code.zip")
+	writeZip(t, name, []zipEntry{
+		{"bin/run", "#!/bin/sh", 0755},
+		{"data.txt", "hello", 0},
+		{"current", "bin/run", os.ModeSymlink | 0777},
+	})
+	dst := filepath.Join(dir, "task")
+	if err := unzip(name, dst, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		mode os.FileMode
+	}{
+		{"bin/run", "#!/bin/sh", 0755},
+		{"data.txt", "hello", 0644},
+		{"current", "#!/bin/sh", 0755},
+	}
+	for _, tt := range tests {
+		p := filepath.Join(dst, tt.name)
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(b) != tt.body {
+			t.Errorf("%s: body = %q, want %q", tt.name, b, tt.body)
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != tt.mode {
+			t.Errorf("%s: mode = %v, want %v", tt.name, info.Mode().Perm(), tt.mode)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "current")); err != nil || target != "bin/run" {
+		t.Errorf("current: Readlink = %q, %v", target, err)
+	}
+}
@@ -18,27 +18,53 @@ import (
 
 	"github.com/dzeromsk/subslicer"
 
-	"github.com/fsnotify/fsnotify"
 	"golang.org/x/sync/errgroup"
-	"golang.org/x/sync/semaphore"
 )
 
 var (
-	consoleAddr  = flag.String("console", "/tmp/console.sock", "Console socket address")
-	logsAddr     = flag.String("logs", "/tmp/logs.sock", "Logs socket address")
-	httpAddr     = flag.String("http", "127.0.0.1:9090", "HTTP address")
-	task         = flag.String("task", taskdir(), "Lambda task directory")
-	prefix       = flag.String("prefix", homedir(), "Chroot dir prefix")
-	username     = flag.String("user", "root", "Lambda user")
-	groupname    = flag.String("group", "root", "Lambda group")
-	handler      = flag.String("h", "handler.my_handler", "Lambda runtime handler")
-	executionEnv = flag.String("r", "python2.7", "Lambda runtime name")
-	workers      = flag.Int64("workers", 1, "Max workers")
-	debug        = flag.Bool("debug", false, "Run with debug flag enabled")
+	consoleAddr    = flag.String("console", "/tmp/console.sock", "Console socket address")
+	logsAddr       = flag.String("logs", "/tmp/logs.sock", "Logs socket address")
+	httpAddr       = flag.String("http", "127.0.0.1:9090", "HTTP address")
+	task           = flag.String("task", taskdir(), "Lambda task directory or deployment zip")
+	prefix         = flag.String("prefix", homedir(), "Chroot dir prefix")
+	username       = flag.String("user", "root", "Lambda user")
+	groupname      = flag.String("group", "root", "Lambda group")
+	handler        = flag.String("h", "handler.my_handler", "Lambda runtime handler")
+	executionEnv   = flag.String("r", "python2.7", "Lambda runtime name")
+	workers        = flag.Int64("workers", 1, "Max workers")
+	idleTimeout    = flag.Duration("idle-timeout", 0, "Close instances idle longer than timeout")
+	maxLifetime    = flag.Duration("max-lifetime", 0, "Close instances older than lifetime")
+	maxInvocations = flag.Int("max-invocations", 0, "Close instances after number of invocations")
+	queueWait      = flag.Duration("queue-wait", 0, "Max time invocations wait for workers before throttling")
+	debug          = flag.Bool("debug", false, "Run with debug flag enabled")
+	mode           = flag.String("mode", "invoke", "HTTP listener mode (invoke, alb)")
+	multiValue     = flag.Bool("multivalue", false, "Enable ALB multi-value headers and query parameters")
+	configFile     = flag.String("config", "", "Functions config file")
+	envFile        = flag.String("env-file", "", "Environment variables file")
+	envOverride    = flag.Bool("env-override", false, "Allow X-Local-Environment header to override environment of invocation")
+	name           = flag.String("name", "local", "Lambda function name")
+	wsAddr         = flag.String("ws", "", "WebSocket API address")
+	region         = flag.String("region", "us-east-1", "Lambda region")
+	profile        = flag.String("profile", "", "AWS shared config profile passed to functions")
+	stsEndpoint    = flag.String("sts-endpoint", "", "STS endpoint used to assume roles")
+	credsAddr      = flag.String("credentials", "", "Container credentials endpoint address")
+	roleMap        = flag.String("role-map", "", "Role mapping file of credentials endpoint")
+	cassetteMode   = flag.String("cassette", "", "Record or replay outbound HTTP traffic of functions (record, replay)")
+	cassetteDir    = flag.String("cassette-dir", "cassettes", "Cassette files directory")
+	maxRecursion   = flag.Int("max-recursion", 16, "Max invocations of function in call chain before recursive loop is stopped")
+	sandboxNet     = flag.String("sandbox-network", "10.200.0.0/16", "Address range of isolated sandbox networks")
+	asyncDir       = flag.String("async-dir", "", "Asynchronous invocation queue directory (default per config or task)")
+	sqsAddr        = flag.String("sqs", "", "SQS API address")
+	snsAddr        = flag.String("sns", "", "SNS API address")
+	adminAddr      = flag.String("admin", "", "Admin API address")
+	eventsAddr     = flag.String("events", "", "EventBridge API address")
+	retryDelay     = flag.Duration("retry-delay", time.Minute, "Delay before first retry of asynchronous invocation")
 
 	xrayAddr = "127.0.0.1:9090"
 )
 
+const accountID = "123456789012"
+
 var runtimes = map[string]subslicer.Runtime{
 	"python2.7": subslicer.Runtime{
 		Name:   "python2.7",
@@ -59,6 +85,10 @@ var runtimes = map[string]subslicer.Runtime{
 	},
 }
 
+// invokeFunc runs a single invocation of the lambda handler with payload
+// and returns the handler response.
+type invokeFunc func(ctx context.Context, payload []byte) ([]byte, error)
+
 var taskdir = func() string { dir, _ := os.Getwd(); return dir }
 var homedir = func() string { dir, _ := os.UserHomeDir(); return dir }
 
@@ -70,11 +100,17 @@ func main() {
 		logsAddr    = &net.UnixAddr{Net: "unix", Name: *logsAddr}
 	)
 
-	r, ok := runtimes[*executionEnv]
-	if !ok {
-		log.Fatalln("Unknown runtime:", *executionEnv)
+	config := &Config{
+		Functions: []*FunctionConfig{{Name: *name}},
+	}
+	if *configFile != "" {
+		var err error
+		config, err = loadConfig(*configFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
-	log.Println("Selected runtime:", *executionEnv)
+	config.setDefaults()
 
 	// Logs
 	console, err := subslicer.NewUNIXServer(consoleAddr, func(conn net.Conn) {
@@ -115,88 +151,119 @@ func main() {
 	}
 	defer xray.Close()
 
-	r.ConsoleAddr = consoleAddr
-	r.LogsAddr = logsAddr
-	r.User = *username
-	r.Group = *groupname
-	r.Chroot = strings.Replace(r.Chroot, "$PREFIX", *prefix, 1)
+	for name, r := range runtimes {
+		r.ConsoleAddr = consoleAddr
+		r.LogsAddr = logsAddr
+		r.User = *username
+		r.Group = *groupname
+		r.Chroot = strings.Replace(r.Chroot, "$PREFIX", *prefix, 1)
+		runtimes[name] = r
+	}
 
 	// Bootstrap
-	fp := subslicer.FunctionPool{
-		New: func() (f *subslicer.Function, err error) {
-			log.Println("Starting lambda function:", *handler)
-			f, err = subslicer.NewFunction(r, *task, *handler)
-			if err != nil {
-				return
-			}
-			f.Stdout = os.Stdout
-			f.Stderr = os.Stderr
-			return
-		},
+	reg, err := newRegistry(config, *workers, *queueWait)
+	if err != nil {
+		log.Fatalln(err)
 	}
-	defer fp.Purge()
-
-	var sem = semaphore.NewWeighted(*workers)
+	defer reg.Purge()
 
-	http.HandleFunc("/favicon.ico", http.NotFound)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// TODO(dzeromsk): context with timeout
-		ctx := context.Background()
+	for _, fn := range reg.Functions() {
+		log.Println("Selected runtime:", fn.Name, fn.Runtime)
+	}
 
-		if err := sem.Acquire(ctx, 1); err != nil {
-			log.Println(err)
-			return
+	// credentials endpoint replaces keys passed to functions
+	var creds *credentialsServer
+	if *credsAddr != "" {
+		creds, err = newCredentialsServer("http://"+sandboxAddr(*credsAddr)+"/credentials", *roleMap)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, fn := range reg.Functions() {
+			if err := creds.Register(fn); err != nil {
+				log.Fatalln(err)
+			}
 		}
-		defer sem.Release(1)
+	}
 
-		f, err := fp.Get()
-		if err != nil {
-			http.Error(w, "function init failed", http.StatusInternalServerError)
-			log.Println(err)
-			return
+	// nested invocations go through invoke api, unless endpoint is
+	// overridden in config
+	for _, fn := range reg.Functions() {
+		if _, ok := fn.env["AWS_ENDPOINT_URL_LAMBDA"]; !ok {
+			fn.env["AWS_ENDPOINT_URL_LAMBDA"] = "http://" + sandboxAddr(*httpAddr)
+			fn.runtime.Env = envList(fn.env)
 		}
-		defer fp.Put(f)
+	}
 
-		n, err := io.Copy(f, r.Body)
-		if err != nil {
-			if err != io.EOF {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				log.Println(err)
-				return
+	// outbound HTTP record and replay, before isolated networks forward
+	// proxy addresses
+	var ca *certAuthority
+	var proxies []*cassetteProxy
+	for _, fn := range reg.Functions() {
+		if fn.Cassette.Mode == "" {
+			continue
+		}
+		if ca == nil {
+			ca, err = newCertAuthority()
+			if err != nil {
+				log.Fatalln(err)
 			}
 		}
-		if n == 0 {
-			f.Write([]byte("{}"))
+		p, err := newCassetteProxy(fn, ca)
+		if err != nil {
+			log.Fatalln(err)
 		}
+		proxies = append(proxies, p)
+	}
 
-		if err := f.Thaw(); err != nil {
-			http.Error(w, "thaw failed", http.StatusInternalServerError)
-			log.Println(err)
-			return
+	// isolated networks of functions
+	var network *sandboxNetwork
+	for i, fn := range reg.Functions() {
+		if !fn.Network.Isolated {
+			continue
 		}
-
-		if err := f.Invoke(ctx); err != nil {
-			http.Error(w, "invoke failed", http.StatusInternalServerError)
-			log.Println(err)
-			return
+		if network == nil {
+			network, err = newSandboxNetwork(*sandboxNet)
+			if err != nil {
+				log.Fatalln(err)
+			}
 		}
-
-		if err := f.Freeze(); err != nil {
-			http.Error(w, "freeze failed", http.StatusInternalServerError)
-			log.Println(err)
-			return
+		if err := network.Register(fn, i); err != nil {
+			log.Fatalln(err)
 		}
+	}
 
-		if *debug {
-			debug := string(f.Debug())
-			if len(debug) > 0 && debug != "{}" {
-				log.Println(len(debug), debug)
-			}
+	// reload on task dir changes, watched before first build so its
+	// outputs are known
+	watcher, err := newTaskWatcher(reg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	watcher.Build()
+
+	if *asyncDir == "" {
+		dir, err := defaultAsyncDir()
+		if err != nil {
+			log.Fatalln(err)
 		}
+		*asyncDir = dir
+	}
+	queue, err := newAsyncQueue(reg, *asyncDir, *retryDelay)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-		w.Write(f.Response())
-		f.Reset()
-	})
+	api := &lambdaAPI{reg: reg, queue: queue}
+	http.Handle(invokePathPrefix, api)
+
+	switch *mode {
+	case "invoke":
+		http.HandleFunc("/favicon.ico", http.NotFound)
+		http.HandleFunc("/", api.Handler(reg.Default().Name))
+	case "alb":
+		http.HandleFunc("/", albHandler(reg.Invoker(reg.Default().Name), *multiValue))
+	default:
+		log.Fatalln("Unknown mode:", *mode)
+	}
 
 	// TODO(dzeromsk): use group with context shared with other servers
 	// TODO(dzeromsk): should we add (*function).Wait() to errgroup and
@@ -218,73 +285,165 @@ func main() {
 		return xray.Serve()
 	})
 
+	for _, p := range proxies {
+		p := p
+		g.Go(func() error {
+			log.Println("Starting cassette proxy:", p.name, p.cassette.path, p.l.Addr())
+			return p.Serve()
+		})
+	}
+
+	if creds != nil {
+		g.Go(func() error {
+			log.Println("Starting credentials server:", *credsAddr)
+			return http.ListenAndServe(*credsAddr, creds)
+		})
+	}
+
+	// provisioned concurrency
+	go reg.Prewarm()
+
+	// instance recycling
+	g.Go(func() error {
+		return reg.Reaper(time.Second)
+	})
+
+	g.Go(func() error {
+		log.Println("Starting async queue:", *asyncDir)
+		return queue.Serve()
+	})
+
 	// invoke server
 	g.Go(func() error {
 		log.Println("Starting http server:", *httpAddr)
 		return http.ListenAndServe(*httpAddr, nil)
 	})
 
-	// reload with naive debounce
-	purge := make(chan struct{})
-	g.Go(func() error {
-		needsPurge := 0
-		for {
-			var timerChan <-chan time.Time
-			if needsPurge > 0 {
-				timerChan = time.After(200 * time.Millisecond)
-			} else {
-				timerChan = make(chan time.Time)
-			}
-			select {
-			case <-purge:
-				needsPurge++
-				continue
-			case <-timerChan:
-				needsPurge = 0
-				log.Println("Reload")
-				fp.Purge()
+	// websocket api server
+	if *wsAddr != "" {
+		if config.WebSocket == nil {
+			log.Fatalln("WebSocket routes not defined in config")
+		}
+		for route, fn := range config.WebSocket.Routes {
+			if _, ok := reg.Lookup(fn); !ok {
+				log.Fatalln("Unknown function for route:", route, fn)
 			}
 		}
-	})
+		ws := newWebSocketServer(reg, config.WebSocket)
+		g.Go(func() error {
+			log.Println("Starting websocket server:", *wsAddr)
+			return http.ListenAndServe(*wsAddr, ws)
+		})
+	}
 
-	watcher, err := fsnotify.NewWatcher()
+	// sqs queues and event source mappings
+	broker, err := newSQSBroker(config.Queues)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalln(err)
+	}
+	for _, esm := range config.EventSourceMappings {
+		q, ok := broker.Lookup(esm.EventSourceArn)
+		if !ok {
+			log.Fatalln("Unknown event source:", esm.EventSourceArn)
+		}
+		if _, ok := reg.Lookup(esm.FunctionName); !ok {
+			log.Fatalln("Unknown function for event source:", esm.EventSourceArn, esm.FunctionName)
+		}
+		poller := &sqsPoller{reg: reg, queue: q, mapping: esm}
+		g.Go(func() error {
+			log.Println("Starting sqs event source mapping:", poller.queue.Name, poller.mapping.FunctionName)
+			return poller.Serve()
+		})
+	}
+	if *sqsAddr != "" {
+		g.Go(func() error {
+			log.Println("Starting sqs server:", *sqsAddr)
+			return http.ListenAndServe(*sqsAddr, broker)
+		})
 	}
 
-	// TODO(dzeromsk): add subdirs recursively
-	if err := watcher.Add(*task); err != nil {
-		log.Fatal(err)
+	// sns topics
+	topics, err := newSNSBroker(reg, queue, broker, config.Topics)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *snsAddr != "" {
+		g.Go(func() error {
+			log.Println("Starting sns server:", *snsAddr)
+			return http.ListenAndServe(*snsAddr, topics)
+		})
 	}
 
-	// fs event watcher
+	// stream event sources
+	for _, sc := range config.Streams {
+		if _, ok := reg.Lookup(sc.FunctionName); !ok {
+			log.Fatalln("Unknown function for stream:", sc.Path, sc.FunctionName)
+		}
+		source, err := newStreamSource(reg, sc)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		g.Go(func() error {
+			log.Println("Starting stream event source:", source.Path, source.FunctionName)
+			return source.Serve()
+		})
+	}
+
+	// scheduled events
+	sched, err := newScheduler(reg, queue)
+	if err != nil {
+		log.Fatalln(err)
+	}
 	g.Go(func() error {
-		for {
-			select {
-			case _, ok := <-watcher.Events:
-				if !ok {
-					return nil
-				}
-				// TODO(dzeromsk): handle create event and add dirs recursively
-				purge <- struct{}{}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return nil
-				}
-				log.Println("error:", err)
-				return err
-			}
+		return sched.Serve()
+	})
+
+	// event bus
+	bus, err := newEventBus(reg, queue, config.Rules)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *eventsAddr != "" {
+		g.Go(func() error {
+			log.Println("Starting events server:", *eventsAddr)
+			return http.ListenAndServe(*eventsAddr, bus)
+		})
+	}
+
+	// s3 bucket notifications
+	for _, bc := range config.Buckets {
+		bucket, err := newS3Bucket(reg, queue, bc)
+		if err != nil {
+			log.Fatalln(err)
 		}
+		g.Go(func() error {
+			log.Println("Starting s3 bucket notifications:", bucket.Name, bucket.Path)
+			return bucket.Serve()
+		})
+	}
+
+	if *adminAddr != "" {
+		g.Go(func() error {
+			log.Println("Starting admin server:", *adminAddr)
+			return http.ListenAndServe(*adminAddr, adminHandler(sched))
+		})
+	}
+
+	g.Go(func() error {
+		return watcher.Serve()
 	})
 
 	// TODO(dzeromsk): move to errgroup
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		log.Println("Signal")
 		// TODO(dzeromsk): handle errors and cleanup
-		fp.Purge()
+		reg.Purge()
+		if network != nil {
+			network.Close()
+		}
 		console.Close()
 		logs.Close()
 		xray.Close()
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dzeromsk/subslicer"
+)
+
+// netnsPrefix names network namespaces and interfaces of sandboxes.
+const netnsPrefix = "lls"
+
+// sandboxNetwork sets up network namespaces of isolated instances. Each
+// instance gets /30 subnet of -sandbox-network range and veth pair with
+// host side as gateway, egress of functions is filtered in their own
+// iptables chains.
+type sandboxNetwork struct {
+	subnet *net.IPNet
+
+	m      sync.Mutex
+	used   map[int]bool
+	chains []string
+	closed bool
+}
+
+func newSandboxNetwork(cidr string) (*sandboxNetwork, error) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if ones, bits := subnet.Mask.Size(); bits != 32 || ones > 30 {
+		return nil, fmt.Errorf("sandbox network must be IPv4 range of at least /30: %s", cidr)
+	}
+	n := &sandboxNetwork{subnet: subnet, used: make(map[int]bool)}
+
+	// namespaces left by previous run
+	stale, _ := filepath.Glob("/var/run/netns/" + netnsPrefix + "-*")
+	for _, name := range stale {
+		run("ip", "link", "del", netnsPrefix+"h"+strings.TrimPrefix(filepath.Base(name), netnsPrefix+"-"))
+		run("ip", "netns", "del", filepath.Base(name))
+	}
+
+	if err := ioutil.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		return nil, fmt.Errorf("enable ip forwarding: %v", err)
+	}
+	masquerade := []string{"POSTROUTING", "-s", subnet.String(), "!", "-d", subnet.String(), "-j", "MASQUERADE"}
+	run(append([]string{"iptables", "-t", "nat", "-D"}, masquerade...)...)
+	if err := run(append([]string{"iptables", "-t", "nat", "-A"}, masquerade...)...); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Register makes instances of function start in own network namespace,
+// index of function names its egress chain. Host loopback addresses in
+// Forward, credentials endpoint, invoke api and xray daemon are forwarded
+// into sandbox.
+func (n *sandboxNetwork) Register(fn *function, index int) error {
+	chain := fmt.Sprintf("%s-%d", strings.ToUpper(netnsPrefix), index)
+	run("iptables", "-N", chain)
+	if err := run("iptables", "-F", chain); err != nil {
+		return err
+	}
+	n.m.Lock()
+	n.chains = append(n.chains, chain)
+	n.m.Unlock()
+
+	var rules [][]string
+	switch {
+	case fn.Network.Offline:
+	case len(fn.Network.Egress) > 0:
+		var err error
+		if rules, err = allowlist(fn); err != nil {
+			return fmt.Errorf("%s: %v", fn.Name, err)
+		}
+		go n.refresh(fn, chain, rules)
+	default:
+		// unrestricted egress
+		rules = append(rules, nil)
+	}
+	for _, r := range rules {
+		if err := run(append(append([]string{"iptables", "-A", chain}, r...), "-j", "ACCEPT")...); err != nil {
+			return err
+		}
+	}
+	if err := run("iptables", "-A", chain, "-j", "REJECT"); err != nil {
+		return err
+	}
+
+	forward := append([]string(nil), fn.Network.Forward...)
+	if *credsAddr != "" {
+		forward = append(forward, sandboxAddr(*credsAddr))
+	}
+	for _, addr := range forward {
+		if !loopback(addr) {
+			return fmt.Errorf("%s: forward address must be loopback address with port: %s", fn.Name, addr)
+		}
+	}
+	// invoke api for nested invocations
+	if addr := sandboxAddr(*httpAddr); loopback(addr) {
+		forward = append(forward, addr)
+	}
+
+	fn.runtime.Network = func() (string, func(), error) {
+		return n.open(chain, forward)
+	}
+	return nil
+}
+
+// loopback reports whether addr is loopback address with port.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	return err == nil && ip != nil && ip.IsLoopback()
+}
+
+// allowlist returns iptables matches of egress allowlist of function.
+// Name servers the sandbox queries are allowed, they are not in the list.
+func allowlist(fn *function) ([][]string, error) {
+	var rules [][]string
+	servers := resolvers(fn.runtime.Chroot)
+	if len(servers) == 0 {
+		// unknown resolver, DNS to any address
+		servers = []string{"0.0.0.0/0"}
+	}
+	for _, ip := range servers {
+		rules = append(rules,
+			[]string{"-d", ip, "-p", "udp", "--dport", "53"},
+			[]string{"-d", ip, "-p", "tcp", "--dport", "53"},
+		)
+	}
+	for _, dest := range fn.Network.Egress {
+		r, err := egressRules(dest)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r...)
+	}
+	return rules, nil
+}
+
+// resolvers returns IPv4 name servers of resolv.conf in chroot, or of the
+// host, loopback ones are not reachable from sandbox.
+func resolvers(chroot string) []string {
+	for _, name := range []string{filepath.Join(chroot, "etc", "resolv.conf"), "/etc/resolv.conf"} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		var servers []string
+		for _, line := range strings.Split(string(data), "\n") {
+			f := strings.Fields(line)
+			if len(f) < 2 || f[0] != "nameserver" {
+				continue
+			}
+			if ip := net.ParseIP(f[1]); ip != nil && ip.To4() != nil && !ip.IsLoopback() {
+				servers = append(servers, ip.String())
+			}
+		}
+		if len(servers) > 0 {
+			return servers
+		}
+	}
+	return nil
+}
+
+// refresh re-resolves egress hosts of function every minute, rules of
+// new addresses are added before rules of old ones are removed.
+func (n *sandboxNetwork) refresh(fn *function, chain string, rules [][]string) {
+	key := func(r []string) string { return strings.Join(r, " ") }
+	for range time.Tick(time.Minute) {
+		next, err := allowlist(fn)
+		if err != nil {
+			log.Println("network:", fn.Name, err)
+			continue
+		}
+		old := make(map[string]bool)
+		for _, r := range rules {
+			old[key(r)] = true
+		}
+		current := make(map[string]bool)
+		for _, r := range next {
+			current[key(r)] = true
+		}
+
+		n.m.Lock()
+		if n.closed {
+			n.m.Unlock()
+			return
+		}
+		for _, r := range next {
+			if !old[key(r)] {
+				run(append(append([]string{"iptables", "-I", chain, "1"}, r...), "-j", "ACCEPT")...)
+			}
+		}
+		for _, r := range rules {
+			if !current[key(r)] {
+				run(append(append([]string{"iptables", "-D", chain}, r...), "-j", "ACCEPT")...)
+			}
+		}
+		n.m.Unlock()
+		rules = next
+	}
+}
+
+// egressRules returns iptables matches of destination, host names are
+// resolved with every refresh.
+func egressRules(dest string) ([][]string, error) {
+	host, port := dest, ""
+	if i := strings.LastIndexByte(dest, ':'); i >= 0 {
+		host, port = dest[:i], dest[i+1:]
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("invalid egress port: %s", dest)
+		}
+	}
+
+	var cidrs []string
+	if _, ipnet, err := net.ParseCIDR(host); err == nil {
+		cidrs = append(cidrs, ipnet.String())
+	} else if ip := net.ParseIP(host); ip != nil {
+		cidrs = append(cidrs, ip.String())
+	} else {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				cidrs = append(cidrs, ip.String())
+			}
+		}
+		if len(cidrs) == 0 {
+			return nil, fmt.Errorf("no IPv4 address of egress host: %s", host)
+		}
+	}
+
+	var rules [][]string
+	for _, cidr := range cidrs {
+		if port == "" {
+			rules = append(rules, []string{"-d", cidr})
+			continue
+		}
+		rules = append(rules,
+			[]string{"-d", cidr, "-p", "tcp", "--dport", port},
+			[]string{"-d", cidr, "-p", "udp", "--dport", port},
+		)
+	}
+	return rules, nil
+}
+
+// open creates network namespace of instance, release removes it.
+func (n *sandboxNetwork) open(chain string, forward []string) (string, func(), error) {
+	i, err := n.alloc()
+	if err != nil {
+		return "", nil, err
+	}
+
+	name := fmt.Sprintf("%s-%d", netnsPrefix, i)
+	netns := "/var/run/netns/" + name
+	hostIface := fmt.Sprintf("%sh%d", netnsPrefix, i)
+	sandboxIface := fmt.Sprintf("%ss%d", netnsPrefix, i)
+	hostIP, sandboxIP := n.addrs(i)
+	filter := [][]string{
+		{"FORWARD", "-i", hostIface, "-j", chain},
+		{"FORWARD", "-o", hostIface, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+		{"INPUT", "-i", hostIface, "-j", chain},
+	}
+
+	var listeners []io.Closer
+	release := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		for _, r := range filter {
+			run(append([]string{"iptables", "-D"}, r...)...)
+		}
+		run("ip", "link", "del", hostIface)
+		run("ip", "netns", "del", name)
+		n.free(i)
+	}
+
+	cmds := [][]string{
+		{"ip", "netns", "add", name},
+		{"ip", "link", "add", hostIface, "type", "veth", "peer", "name", sandboxIface, "netns", name},
+		{"ip", "addr", "add", hostIP + "/30", "dev", hostIface},
+		{"ip", "link", "set", hostIface, "up"},
+		{"ip", "-n", name, "link", "set", "lo", "up"},
+		{"ip", "-n", name, "addr", "add", sandboxIP + "/30", "dev", sandboxIface},
+		{"ip", "-n", name, "link", "set", sandboxIface, "up"},
+		{"ip", "-n", name, "route", "add", "default", "via", hostIP},
+	}
+	for _, r := range filter {
+		cmds = append(cmds, append([]string{"iptables", "-I"}, r...))
+	}
+	for _, cmd := range cmds {
+		if err := run(cmd...); err != nil {
+			release()
+			return "", nil, err
+		}
+	}
+
+	for _, addr := range forward {
+		l, err := subslicer.ListenInNetns(netns, "tcp", addr)
+		if err != nil {
+			release()
+			return "", nil, err
+		}
+		listeners = append(listeners, l)
+		go proxy(l, addr)
+	}
+	// trace segments sent to xray daemon
+	c, err := subslicer.ListenPacketInNetns(netns, "udp", xrayAddr)
+	if err != nil {
+		release()
+		return "", nil, err
+	}
+	listeners = append(listeners, c)
+	go proxyPacket(c, xrayAddr)
+	return netns, release, nil
+}
+
+// addrs returns host and sandbox addresses of i-th /30 subnet.
+func (n *sandboxNetwork) addrs(i int) (string, string) {
+	base := n.subnet.IP.To4()
+	v := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])
+	v += uint32(i) * 4
+	ip := func(v uint32) string {
+		return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v)).String()
+	}
+	return ip(v + 1), ip(v + 2)
+}
+
+func (n *sandboxNetwork) alloc() (int, error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	ones, _ := n.subnet.Mask.Size()
+	for i := 0; i < 1<<uint(30-ones); i++ {
+		if !n.used[i] {
+			n.used[i] = true
+			return i, nil
+		}
+	}
+	return 0, errors.New("sandbox network exhausted")
+}
+
+func (n *sandboxNetwork) free(i int) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	delete(n.used, i)
+}
+
+// Close removes NAT rule and egress chains, instances must be closed
+// first.
+func (n *sandboxNetwork) Close() {
+	n.m.Lock()
+	defer n.m.Unlock()
+	run("iptables", "-t", "nat", "-D", "POSTROUTING", "-s", n.subnet.String(), "!", "-d", n.subnet.String(), "-j", "MASQUERADE")
+	for _, chain := range n.chains {
+		run("iptables", "-F", chain)
+		run("iptables", "-X", chain)
+	}
+	n.chains = nil
+	n.closed = true
+}
+
+// proxy forwards connections accepted in sandbox to host address.
+func proxy(l net.Listener, addr string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			upstream, err := net.Dial("tcp", addr)
+			if err != nil {
+				log.Println("proxy:", err)
+				return
+			}
+			defer upstream.Close()
+
+			done := make(chan struct{}, 2)
+			go func() {
+				io.Copy(upstream, conn)
+				done <- struct{}{}
+			}()
+			go func() {
+				io.Copy(conn, upstream)
+				done <- struct{}{}
+			}()
+			<-done
+		}()
+	}
+}
+
+// proxyPacket forwards datagrams received in sandbox to host address,
+// replies are not sent back.
+func proxyPacket(c net.PacketConn, addr string) {
+	upstream, err := net.Dial("udp", addr)
+	if err != nil {
+		log.Println("proxy:", err)
+		return
+	}
+	defer upstream.Close()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		upstream.Write(buf[:n])
+	}
+}
+
+// run runs command, output is part of error.
+func run(args ...string) error {
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	if *debug {
+		log.Println("network:", strings.Join(args, " "))
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// maxZippedSize is Lambda limit of deployment package uploaded directly.
+const maxZippedSize = 52428800
+
+// unpackPackage unpacks deployment zip into cache dir named by hash of its
+// contents, so unchanged packages are unpacked once. File modes are kept.
+func unpackPackage(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > maxZippedSize {
+		return "", fmt.Errorf("zipped size %d of %s must be smaller than %d bytes", info.Size(), name, maxZippedSize)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	cache, err := cacheDir("packages")
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(cache, hex.EncodeToString(h.Sum(nil))[:16])
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+
+	// check before unpacking anything
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	var size uint64
+	for _, f := range r.File {
+		size += f.UncompressedSize64
+	}
+	r.Close()
+	if size > maxUnzippedSize {
+		return "", fmt.Errorf("unzipped size %d of %s must be smaller than %d bytes", size, name, maxUnzippedSize)
+	}
+
+	tmp, err := ioutil.TempDir(cache, "tmp")
+	if err != nil {
+		return "", err
+	}
+	if err := unzip(name, tmp, maxUnzippedSize); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	// sandbox user must be able to read the tree
+	os.Chmod(tmp, 0755)
+	if err := os.Rename(tmp, dir); err != nil {
+		// unpacked concurrently by other server
+		os.RemoveAll(tmp)
+	}
+	return dir, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// eventPattern is EventBridge event pattern. Leaf values are arrays of
+// matchers: literals, or objects with prefix, suffix, anything-but,
+// numeric, exists or equals-ignore-case operators.
+type eventPattern map[string]interface{}
+
+func parseEventPattern(data []byte) (eventPattern, error) {
+	var p eventPattern
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p eventPattern) validate() error {
+	for key, v := range p {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if err := eventPattern(v).validate(); err != nil {
+				return err
+			}
+		case []interface{}:
+			for _, m := range v {
+				switch m := m.(type) {
+				case map[string]interface{}:
+					if len(m) != 1 {
+						return fmt.Errorf("pattern %s: matcher must have exactly one operator", key)
+					}
+					for name, arg := range m {
+						if err := validateOperator(name, arg); err != nil {
+							return fmt.Errorf("pattern %s: %v", key, err)
+						}
+					}
+				case string, float64, bool, nil:
+				default:
+					return fmt.Errorf("pattern %s: matcher must be a literal or an object", key)
+				}
+			}
+		default:
+			return fmt.Errorf("pattern %s: value must be an object or an array", key)
+		}
+	}
+	return nil
+}
+
+// validateOperator checks argument of operator like EventBridge does, so
+// malformed patterns fail at load instead of never matching.
+func validateOperator(name string, arg interface{}) error {
+	switch name {
+	case "prefix", "suffix", "equals-ignore-case":
+		if _, ok := arg.(string); !ok {
+			return fmt.Errorf("%s must be a string", name)
+		}
+	case "exists":
+		if _, ok := arg.(bool); !ok {
+			return fmt.Errorf("exists must be a boolean")
+		}
+	case "anything-but":
+		switch arg := arg.(type) {
+		case string, float64:
+		case []interface{}:
+			if len(arg) == 0 {
+				return fmt.Errorf("anything-but list must not be empty")
+			}
+			for _, a := range arg {
+				switch a.(type) {
+				case string, float64:
+				default:
+					return fmt.Errorf("anything-but list must contain strings or numbers")
+				}
+			}
+		case map[string]interface{}:
+			if len(arg) != 1 {
+				return fmt.Errorf("anything-but must have exactly one operator")
+			}
+			for op, v := range arg {
+				switch op {
+				case "prefix", "suffix", "equals-ignore-case":
+					if _, ok := v.(string); !ok {
+						return fmt.Errorf("anything-but %s must be a string", op)
+					}
+				default:
+					return fmt.Errorf("unsupported anything-but operator %s", op)
+				}
+			}
+		default:
+			return fmt.Errorf("anything-but must be a string, number, list or object")
+		}
+	case "numeric":
+		args, ok := arg.([]interface{})
+		if !ok || len(args) == 0 || len(args) > 4 || len(args)%2 != 0 {
+			return fmt.Errorf("numeric must be a list of operator and number pairs")
+		}
+		for i := 0; i < len(args); i += 2 {
+			switch args[i] {
+			case "=", "<", "<=", ">", ">=":
+			default:
+				return fmt.Errorf("unsupported numeric operator %v", args[i])
+			}
+			if _, ok := args[i+1].(float64); !ok {
+				return fmt.Errorf("numeric value must be a number: %v", args[i+1])
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported operator %s", name)
+	}
+	return nil
+}
+
+// Match reports whether event matches pattern.
+func (p eventPattern) Match(event map[string]interface{}) bool {
+	for key, v := range p {
+		value, exists := event[key]
+		switch v := v.(type) {
+		case map[string]interface{}:
+			nested, ok := value.(map[string]interface{})
+			if !ok || !eventPattern(v).Match(nested) {
+				return false
+			}
+		case []interface{}:
+			if !matchAny(v, value, exists) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// matchAny reports whether any of matchers matches value, array values
+// match when any of their elements does.
+func matchAny(matchers []interface{}, value interface{}, exists bool) bool {
+	values := []interface{}{value}
+	if array, ok := value.([]interface{}); ok {
+		values = array
+	}
+	for _, m := range matchers {
+		if op, ok := m.(map[string]interface{}); ok {
+			if want, ok := op["exists"].(bool); ok {
+				if want == exists {
+					return true
+				}
+				continue
+			}
+		}
+		if !exists {
+			continue
+		}
+		for _, v := range values {
+			if matchValue(m, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchValue(m interface{}, v interface{}) bool {
+	op, ok := m.(map[string]interface{})
+	if !ok {
+		return equalLiteral(m, v)
+	}
+
+	for name, arg := range op {
+		switch name {
+		case "prefix":
+			s, ok := v.(string)
+			prefix, _ := arg.(string)
+			if !ok || !strings.HasPrefix(s, prefix) {
+				return false
+			}
+		case "suffix":
+			s, ok := v.(string)
+			suffix, _ := arg.(string)
+			if !ok || !strings.HasSuffix(s, suffix) {
+				return false
+			}
+		case "equals-ignore-case":
+			s, ok := v.(string)
+			other, _ := arg.(string)
+			if !ok || !strings.EqualFold(s, other) {
+				return false
+			}
+		case "anything-but":
+			switch arg := arg.(type) {
+			case []interface{}:
+				for _, a := range arg {
+					if equalLiteral(a, v) {
+						return false
+					}
+				}
+			case map[string]interface{}:
+				if matchValue(arg, v) {
+					return false
+				}
+			default:
+				if equalLiteral(arg, v) {
+					return false
+				}
+			}
+		case "numeric":
+			n, ok := v.(float64)
+			args, _ := arg.([]interface{})
+			if !ok || !matchNumeric(args, n) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// matchNumeric evaluates numeric conditions like [">", 0, "<=", 5].
+func matchNumeric(args []interface{}, n float64) bool {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return false
+	}
+	for i := 0; i < len(args); i += 2 {
+		op, _ := args[i].(string)
+		x, ok := args[i+1].(float64)
+		if !ok {
+			return false
+		}
+		var match bool
+		switch op {
+		case "=":
+			match = n == x
+		case "<":
+			match = n < x
+		case "<=":
+			match = n <= x
+		case ">":
+			match = n > x
+		case ">=":
+			match = n >= x
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// equalLiteral compares pattern literal with event value, values that are
+// not json scalars never match.
+func equalLiteral(literal, v interface{}) bool {
+	switch literal.(type) {
+	case string, float64, bool, nil:
+		return literal == v
+	}
+	return false
+}
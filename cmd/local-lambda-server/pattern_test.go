@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEventPatternMatch(t *testing.T) {
+	event := `{
+		"source": "orders",
+		"detail-type": "Order Placed",
+		"detail": {
+			"id": "o-123",
+			"amount": 42,
+			"status": "NEW",
+			"tags": ["priority", "gift"],
+			"customer": {"country": "PL"}
+		}
+	}`
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{`{"source": ["orders"]}`, true},
+		{`{"source": ["payments"]}`, false},
+		{`{"source": ["payments", "orders"]}`, true},
+		{`{"detail": {"customer": {"country": ["PL"]}}}`, true},
+		{`{"detail": {"customer": {"country": ["DE"]}}}`, false},
+		{`{"detail": {"missing": {"country": ["PL"]}}}`, false},
+		{`{"detail": {"tags": ["gift"]}}`, true},
+		{`{"detail": {"tags": ["sale"]}}`, false},
+		{`{"detail": {"id": [{"prefix": "o-"}]}}`, true},
+		{`{"detail": {"id": [{"prefix": "x-"}]}}`, false},
+		{`{"detail": {"id": [{"suffix": "123"}]}}`, true},
+		{`{"detail": {"id": [{"suffix": "124"}]}}`, false},
+		{`{"detail": {"status": [{"equals-ignore-case": "new"}]}}`, true},
+		{`{"detail": {"status": [{"anything-but": "NEW"}]}}`, false},
+		{`{"detail": {"status": [{"anything-but": ["OLD", "DONE"]}]}}`, true},
+		{`{"detail": {"status": [{"anything-but": {"prefix": "N"}}]}}`, false},
+		{`{"detail": {"amount": [{"numeric": [">", 40, "<=", 42]}]}}`, true},
+		{`{"detail": {"amount": [{"numeric": ["<", 42]}]}}`, false},
+		{`{"detail": {"amount": [{"numeric": ["=", 42]}]}}`, true},
+		{`{"detail": {"amount": [42]}}`, true},
+		{`{"detail": {"amount": ["42"]}}`, false},
+		{`{"detail": {"status": [{"exists": true}]}}`, true},
+		{`{"detail": {"status": [{"exists": false}]}}`, false},
+		{`{"detail": {"coupon": [{"exists": false}]}}`, true},
+		{`{"detail": {"coupon": [{"exists": true}]}}`, false},
+		{`{"detail": {"coupon": [null]}}`, false},
+		{`{"detail-type": ["Order Placed"], "detail": {"amount": [{"numeric": [">", 100]}]}}`, false},
+	}
+
+	var e map[string]interface{}
+	if err := json.Unmarshal([]byte(event), &e); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		p, err := parseEventPattern([]byte(tt.pattern))
+		if err != nil {
+			t.Errorf("parseEventPattern(%s): %v", tt.pattern, err)
+			continue
+		}
+		if got := p.Match(e); got != tt.want {
+			t.Errorf("%s: Match = %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestParseEventPatternInvalid(t *testing.T) {
+	tests := []string{
+		`[]`,
+		`{"source": "orders"}`,
+		`{"source": 1}`,
+		`{"detail": {"id": [{"wildcard": "o-*"}]}}`,
+		`{"detail": {"id": [["o-123"]]}}`,
+		`{"detail": {"id": [{"prefix": "o-", "suffix": "3"}]}}`,
+		`{"detail": {"id": [{"prefix": 1}]}}`,
+		`{"detail": {"id": [{"exists": "yes"}]}}`,
+		`{"detail": {"status": [{"anything-but": []}]}}`,
+		`{"detail": {"status": [{"anything-but": {"numeric": [">", 1]}}]}}`,
+		`{"detail": {"amount": [{"numeric": [">", 40, "<="]}]}}`,
+		`{"detail": {"amount": [{"numeric": ["!=", 40]}]}}`,
+		`{"detail": {"amount": [{"numeric": [">", "40"]}]}}`,
+		`{"detail": {"amount": [{"numeric": []}]}}`,
+		`{"detail": {"amount": [{"numeric": 40}]}}`,
+	}
+	for _, pattern := range tests {
+		if _, err := parseEventPattern([]byte(pattern)); err == nil {
+			t.Errorf("parseEventPattern(%s): expected error", pattern)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dzeromsk/subslicer"
+)
+
+// caBundles are trust stores of runtimes, generated CA is added to ones
+// found in chroot.
+var caBundles = []string{
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/certs/ca-certificates.crt",
+}
+
+// hopHeaders are not passed to upstream servers.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// secretHeaders are not saved in cassettes.
+var secretHeaders = []string{
+	"Authorization",
+	"X-Amz-Security-Token",
+}
+
+// certAuthority issues certificates of hosts intercepted by proxies.
+type certAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	PEM  []byte
+
+	m     sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+func newCertAuthority() (*certAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "local-lambda-server CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &certAuthority{
+		cert:  cert,
+		key:   key,
+		PEM:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		certs: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// Certificate returns certificate of host, certificates are cached.
+func (ca *certAuthority) Certificate(host string) (*tls.Certificate, error) {
+	ca.m.Lock()
+	defer ca.m.Unlock()
+	if cert, ok := ca.certs[host]; ok {
+		return cert, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 1, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key}
+	ca.certs[host] = cert
+	return cert, nil
+}
+
+func serialNumber() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return n
+}
+
+// cassetteProxy is HTTP(S) proxy of function recording outbound requests
+// to cassette or replaying them from it. HTTPS is intercepted with
+// certificates of generated CA trusted in sandbox.
+type cassetteProxy struct {
+	name      string
+	record    bool
+	cassette  *cassette
+	ca        *certAuthority
+	transport *http.Transport
+	l         net.Listener
+}
+
+// newCassetteProxy starts listening for function and points HTTP_PROXY
+// variables of function at it, CA is added to trust stores of sandbox.
+func newCassetteProxy(fn *function, ca *certAuthority) (*cassetteProxy, error) {
+	p := &cassetteProxy{
+		name: fn.Name,
+		ca:   ca,
+		transport: &http.Transport{
+			// keep bodies as sent by servers
+			DisableCompression:  true,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+	switch fn.Cassette.Mode {
+	case "record":
+		p.record = true
+		p.cassette = &cassette{path: fn.Cassette.Path}
+	case "replay":
+		c, err := loadCassette(fn.Cassette.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fn.Name, err)
+		}
+		p.cassette = c
+	default:
+		return nil, fmt.Errorf("%s: unknown cassette mode: %s", fn.Name, fn.Cassette.Mode)
+	}
+
+	bundle, mounts, err := writeCABundle(fn, ca)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn.Name, err)
+	}
+
+	p.l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	addr := p.l.Addr().String()
+
+	noProxy := "localhost,127.0.0.1"
+	if v := fn.env["NO_PROXY"]; v != "" {
+		noProxy = v + "," + noProxy
+	}
+	for k, v := range map[string]string{
+		"HTTP_PROXY":          "http://" + addr,
+		"HTTPS_PROXY":         "http://" + addr,
+		"http_proxy":          "http://" + addr,
+		"https_proxy":         "http://" + addr,
+		"NO_PROXY":            noProxy,
+		"no_proxy":            noProxy,
+		"SSL_CERT_FILE":       bundle,
+		"REQUESTS_CA_BUNDLE":  bundle,
+		"AWS_CA_BUNDLE":       bundle,
+		"NODE_EXTRA_CA_CERTS": bundle,
+	} {
+		fn.env[k] = v
+	}
+	fn.runtime.Env = envList(fn.env)
+	fn.runtime.Mounts = append(fn.runtime.Mounts[:len(fn.runtime.Mounts):len(fn.runtime.Mounts)], mounts...)
+	// isolated sandboxes reach proxy through forwarded address
+	fn.Network.Forward = append(fn.Network.Forward, addr)
+	return p, nil
+}
+
+// writeCABundle writes trust store of chroot with CA added, it returns
+// path of trust store in sandbox and mounts replacing trust stores.
+func writeCABundle(fn *function, ca *certAuthority) (string, []subslicer.Mount, error) {
+	dir := filepath.Join(os.TempDir(), "local-lambda-server", "ca")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, err
+	}
+
+	var bundle string
+	var mounts []subslicer.Mount
+	for i, name := range caBundles {
+		data, err := ioutil.ReadFile(filepath.Join(fn.runtime.Chroot, name))
+		if err != nil {
+			continue
+		}
+		src := filepath.Join(dir, fmt.Sprintf("%s-%d.pem", fn.Name, i))
+		if err := ioutil.WriteFile(src, append(append(data, '\n'), ca.PEM...), 0644); err != nil {
+			return "", nil, err
+		}
+		mounts = append(mounts, subslicer.Mount{Src: src, Dst: name})
+		if bundle == "" {
+			bundle = name
+		}
+	}
+	if bundle == "" {
+		return "", nil, fmt.Errorf("no CA bundle in chroot, looked for %s", strings.Join(caBundles, ", "))
+	}
+	return bundle, mounts, nil
+}
+
+func (p *cassetteProxy) Serve() error {
+	return http.Serve(p.l, p)
+}
+
+func (p *cassetteProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+		return
+	}
+
+	resp := p.roundTrip(r)
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.Status)
+	w.Write(resp.bytes())
+}
+
+// connect intercepts TLS connection to host, requests are read from it
+// one by one.
+func (p *cassetteProxy) connect(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		log.Println("cassette:", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	host := r.URL.Hostname()
+	config := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return p.ca.Certificate(hello.ServerName)
+			}
+			return p.ca.Certificate(host)
+		},
+		NextProtos: []string{"http/1.1"},
+	}
+	tlsConn := tls.Server(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Println("cassette:", p.name, host, err)
+		return
+	}
+
+	br := bufio.NewReader(tlsConn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		req.URL.Scheme = "https"
+		req.URL.Host = req.Host
+		if req.URL.Host == "" {
+			req.URL.Host = r.Host
+		}
+		req.URL.Host = strings.TrimSuffix(req.URL.Host, ":443")
+
+		resp := p.roundTrip(req)
+		body := resp.bytes()
+		out := &http.Response{
+			StatusCode:    resp.Status,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        resp.Header,
+			Body:          ioutil.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Close:         req.Close,
+		}
+		if err := out.Write(tlsConn); err != nil || req.Close {
+			return
+		}
+	}
+}
+
+// roundTrip replays request from cassette, or sends it upstream and
+// records it.
+func (p *cassetteProxy) roundTrip(r *http.Request) *recordedResponse {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, err)
+	}
+	url := r.URL.String()
+
+	if !p.record {
+		it := p.cassette.Match(r.Method, url, body)
+		if it == nil {
+			log.Println("cassette:", p.name, "unmatched request", r.Method, url)
+			return errorResponse(http.StatusBadGateway, errors.New("unmatched request: "+r.Method+" "+url))
+		}
+		resp := it.Response
+		resp.Header = cloneHeader(resp.Header)
+		return &resp
+	}
+
+	req, err := http.NewRequest(r.Method, url, bytes.NewReader(body))
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, err)
+	}
+	req.Header = cloneHeader(r.Header)
+	for _, k := range hopHeaders {
+		req.Header.Del(k)
+	}
+	upstream, err := p.transport.RoundTrip(req)
+	if err != nil {
+		log.Println("cassette:", p.name, err)
+		return errorResponse(http.StatusBadGateway, err)
+	}
+	defer upstream.Body.Close()
+	data, err := ioutil.ReadAll(upstream.Body)
+	if err != nil {
+		return errorResponse(http.StatusBadGateway, err)
+	}
+
+	resp := &recordedResponse{
+		Status:       upstream.StatusCode,
+		Header:       cloneHeader(upstream.Header),
+		recordedBody: newBody(data),
+	}
+	for _, k := range hopHeaders {
+		resp.Header.Del(k)
+	}
+	resp.Header.Del("Content-Length")
+
+	it := &interaction{
+		Request: recordedRequest{
+			Method:       r.Method,
+			URL:          url,
+			Header:       cloneHeader(req.Header),
+			recordedBody: newBody(body),
+		},
+		Response: *resp,
+	}
+	for _, k := range secretHeaders {
+		it.Request.Header.Del(k)
+	}
+	if err := p.cassette.Record(it); err != nil {
+		log.Println("cassette:", p.name, err)
+	}
+	return resp
+}
+
+func errorResponse(status int, err error) *recordedResponse {
+	return &recordedResponse{
+		Status:       status,
+		Header:       http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		recordedBody: newBody([]byte(err.Error() + "\n")),
+	}
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
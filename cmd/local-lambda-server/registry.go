@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dzeromsk/subslicer"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// errFunctionError is returned with the error response when handler
+// fails, like X-Amz-Function-Error: Unhandled in lambda api.
+var errFunctionError = errors.New("function error")
+
+// Invocations over concurrency limits are throttled, like lambda
+// TooManyRequestsException.
+var (
+	errThrottled         = errors.New("Rate Exceeded.")
+	errReservedThrottled = errors.New("Rate Exceeded, reserved concurrency limit reached.")
+)
+
+// function is a lambda function with its pool of sandboxed instances.
+type function struct {
+	*FunctionConfig
+
+	runtime subslicer.Runtime
+	pool    subslicer.FunctionPool
+
+	// sem limits concurrency of function, reserved or shared with other
+	// functions without reserved concurrency
+	sem *semaphore.Weighted
+
+	// env are variables of function from config and env file
+	env map[string]string
+	// creds are host credentials, or role credentials for functions with
+	// execution role
+	creds *cachedCredentials
+
+	// code is dir mounted at /var/task, task dir or unpacked deployment
+	// package replaced on reload, stale packages are removed once their
+	// instances are drained. opt is merged layers dir.
+	m     sync.Mutex
+	code  string
+	stale []string
+	opt   string
+}
+
+// registry holds all functions served by local-lambda-server. Workers are
+// account concurrency limit, functions with reserved concurrency get their
+// own part of it and the rest is shared by all other functions.
+type registry struct {
+	sem       *semaphore.Weighted
+	functions map[string]*function
+	order     []string
+
+	// queueWait is max time synchronous invocation waits for concurrency
+	// before it is throttled.
+	queueWait time.Duration
+}
+
+func newRegistry(config *Config, workers int64, queueWait time.Duration) (*registry, error) {
+	reg := &registry{
+		functions: make(map[string]*function),
+		queueWait: queueWait,
+	}
+
+	// functions with role assume it with host credentials
+	host := newCachedCredentials(hostCredentials(*profile))
+
+	unreserved := workers
+	for _, fc := range config.Functions {
+		if n := fc.ReservedConcurrentExecutions; n != nil {
+			if *n < 0 {
+				return nil, fmt.Errorf("invalid reserved concurrency: %s", fc.Name)
+			}
+			unreserved -= int64(*n)
+		}
+	}
+	if unreserved < 0 {
+		return nil, fmt.Errorf("reserved concurrency exceeds workers: %d", workers)
+	}
+	reg.sem = semaphore.NewWeighted(unreserved)
+
+	for _, fc := range config.Functions {
+		if fc.Name == "" {
+			return nil, fmt.Errorf("function name missing: %s", fc.Handler)
+		}
+		if _, ok := reg.functions[fc.Name]; ok {
+			return nil, fmt.Errorf("duplicate function: %s", fc.Name)
+		}
+		r, ok := runtimes[fc.Runtime]
+		if !ok {
+			return nil, fmt.Errorf("unknown runtime: %s", fc.Runtime)
+		}
+
+		env, err := functionEnv(fc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fc.Name, err)
+		}
+		r.Env = envList(env)
+		if len(fc.Endpoints.Hosts) > 0 {
+			hosts, err := writeHosts(fc.Name, fc.Endpoints.Hosts)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", fc.Name, err)
+			}
+			r.Mounts = append(r.Mounts[:len(r.Mounts):len(r.Mounts)], subslicer.Mount{Src: hosts, Dst: "/etc/hosts"})
+		}
+		code := fc.Task
+		if fc.Zip != "" {
+			if code, err = unpackPackage(fc.Zip); err != nil {
+				return nil, fmt.Errorf("%s: %v", fc.Name, err)
+			}
+		}
+		var opt string
+		if len(fc.Layers) > 0 {
+			if opt, err = buildLayers(fc); err != nil {
+				return nil, fmt.Errorf("%s: %v", fc.Name, err)
+			}
+			if err := checkSize(fc, code, opt); err != nil {
+				return nil, fmt.Errorf("%s: %v", fc.Name, err)
+			}
+			log.Println("Layers:", fc.Name, opt)
+		}
+		r.FunctionName = fc.Name
+		r.FunctionArn = functionArn(fc.Name)
+		r.Region = *region
+		r.MemorySize = fc.MemorySize
+		creds := host
+		if fc.Role != "" {
+			creds = newCachedCredentials(assumeRoleSource(host, fc.Role, "local-lambda-server-"+fc.Name))
+		}
+		r.Credentials = creds.Subslicer
+		if r.MemorySize < 128 || r.MemorySize > 10240 {
+			return nil, fmt.Errorf("%s: memory size must be between 128 and 10240 MB", fc.Name)
+		}
+
+		fn := &function{FunctionConfig: fc, runtime: r, sem: reg.sem, env: env, creds: creds, code: code, opt: opt}
+		fn.pool.New = fn.new
+		fn.pool.Min = fc.ProvisionedConcurrentExecutions
+		fn.pool.IdleTimeout = time.Duration(fc.IdleTimeoutInSeconds) * time.Second
+		fn.pool.MaxLifetime = time.Duration(fc.MaxLifetimeInSeconds) * time.Second
+		fn.pool.MaxInvocations = fc.MaxInvocations
+		if n := fc.ReservedConcurrentExecutions; fn.pool.Min < 0 || n != nil && fn.pool.Min > *n {
+			return nil, fmt.Errorf("provisioned concurrency exceeds reserved concurrency: %s", fc.Name)
+		}
+		if n := fc.ReservedConcurrentExecutions; n != nil {
+			fn.sem = semaphore.NewWeighted(int64(*n))
+		} else if unreserved == 0 {
+			return nil, fmt.Errorf("no unreserved concurrency left for function: %s", fc.Name)
+		}
+
+		reg.functions[fc.Name] = fn
+		reg.order = append(reg.order, fc.Name)
+	}
+
+	return reg, nil
+}
+
+func (fn *function) new() (f *subslicer.Function, err error) {
+	return fn.newWithRuntime(fn.runtime)
+}
+
+func (fn *function) newWithRuntime(r subslicer.Runtime) (f *subslicer.Function, err error) {
+	log.Println("Starting lambda function:", fn.Name, fn.Handler)
+	fn.m.Lock()
+	code, opt := fn.code, fn.opt
+	fn.m.Unlock()
+	if opt != "" {
+		r.Mounts = append(r.Mounts[:len(r.Mounts):len(r.Mounts)], subslicer.Mount{Src: opt, Dst: "/opt"})
+	}
+	f, err = subslicer.NewFunction(r, code, fn.Handler)
+	if err != nil {
+		return
+	}
+	f.Stdout = os.Stdout
+	f.Stderr = os.Stderr
+	return
+}
+
+// codeDir returns dir mounted at /var/task of new instances.
+func (fn *function) codeDir() string {
+	fn.m.Lock()
+	defer fn.m.Unlock()
+	return fn.code
+}
+
+// update unpacks changed deployment package and rebuilds changed layers
+// of function, both are replaced only if they fit in size limit.
+func (fn *function) update() error {
+	code := fn.codeDir()
+	if fn.Zip != "" {
+		dir, err := unpackPackage(fn.Zip)
+		if err != nil {
+			return err
+		}
+		code = dir
+	}
+	var opt string
+	if len(fn.Layers) > 0 {
+		dir, err := buildLayers(fn.FunctionConfig)
+		if err != nil {
+			return err
+		}
+		if err := checkSize(fn.FunctionConfig, code, dir); err != nil {
+			return err
+		}
+		opt = dir
+	}
+	fn.m.Lock()
+	defer fn.m.Unlock()
+	fn.code = code
+	fn.opt = opt
+	return nil
+}
+
+// removeStale removes packages replaced by reload, unless used by other
+// functions.
+func (reg *registry) removeStale(fn *function) {
+	fn.m.Lock()
+	stale := fn.stale
+	fn.stale = nil
+	fn.m.Unlock()
+
+	used := make(map[string]bool)
+	for _, fn := range reg.functions {
+		used[fn.codeDir()] = true
+	}
+	for _, dir := range stale {
+		if !used[dir] {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+// Lookup returns function by name, partial or full arn. Qualifiers are
+// ignored as only $LATEST is served.
+func (reg *registry) Lookup(name string) (*function, bool) {
+	if strings.HasPrefix(name, "arn:") {
+		// arn:aws:lambda:region:account:function:name[:qualifier]
+		if parts := strings.Split(name, ":"); len(parts) >= 7 {
+			name = parts[6]
+		}
+	} else if parts := strings.Split(name, ":"); len(parts) == 3 {
+		// account:function:name
+		name = parts[2]
+	} else if len(parts) == 2 {
+		// name:qualifier
+		name = parts[0]
+	}
+	fn, ok := reg.functions[name]
+	return fn, ok
+}
+
+// Default returns first function defined in config.
+func (reg *registry) Default() *function {
+	return reg.functions[reg.order[0]]
+}
+
+// Functions returns all functions in config order.
+func (reg *registry) Functions() []*function {
+	var functions []*function
+	for _, name := range reg.order {
+		functions = append(functions, reg.functions[name])
+	}
+	return functions
+}
+
+// Invoke runs function by name with payload, invocation is throttled when
+// function concurrency limit is reached.
+func (reg *registry) Invoke(ctx context.Context, name string, payload []byte) ([]byte, error) {
+	fn, ok := reg.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("function not found: %s", name)
+	}
+	return reg.invoke(ctx, fn, payload)
+}
+
+// Invoker returns invokeFunc bound to function by name.
+func (reg *registry) Invoker(name string) invokeFunc {
+	return func(ctx context.Context, payload []byte) ([]byte, error) {
+		return reg.Invoke(ctx, name, payload)
+	}
+}
+
+func (reg *registry) invoke(ctx context.Context, fn *function, payload []byte) ([]byte, error) {
+	ctx, err := traceContext(ctx, fn)
+	if err != nil {
+		return nil, err
+	}
+	if err := reg.acquire(ctx, fn); err != nil {
+		return nil, err
+	}
+	defer fn.sem.Release(1)
+
+	f, err := fn.pool.Get()
+	if err != nil {
+		return nil, fmt.Errorf("function init failed: %v", err)
+	}
+
+	start := "warm"
+	if f.Cold {
+		start = "cold"
+	}
+	log.Println("Invoking lambda function:", fn.Name, start, "start")
+
+	response, err := invokeFunction(ctx, f, payload)
+	if f.Generation != fn.pool.Generation() {
+		// reloaded while invoking, instance is closed by pool
+		defer func() {
+			log.Println("Drained lambda function instance:", fn.Name, "remaining", fn.pool.Draining())
+		}()
+	}
+	if err == errFunctionError {
+		// runtime does not accept invocations after handler error,
+		// provisioned instance is replaced in background
+		fn.pool.Discard(f)
+		go reg.prewarm(fn)
+	} else {
+		// instance may be taken by other invocation once put back
+		invocations := f.Invocations
+		fn.pool.Put(f)
+		if invocations >= fn.MaxInvocations && fn.MaxInvocations > 0 {
+			// instance was retired by pool
+			go reg.prewarm(fn)
+		}
+	}
+	return response, err
+}
+
+// invokeWithEnv runs function in new instance with environment variables
+// overridden for single invocation, instance is closed afterwards.
+func (reg *registry) invokeWithEnv(ctx context.Context, fn *function, payload []byte, override map[string]string) ([]byte, error) {
+	vars := make(map[string]string)
+	for k, v := range fn.env {
+		vars[k] = v
+	}
+	for k, v := range override {
+		vars[k] = v
+	}
+	if err := validateEnv(vars); err != nil {
+		return nil, err
+	}
+
+	ctx, err := traceContext(ctx, fn)
+	if err != nil {
+		return nil, err
+	}
+	if err := reg.acquire(ctx, fn); err != nil {
+		return nil, err
+	}
+	defer fn.sem.Release(1)
+
+	r := fn.runtime
+	r.Env = envList(vars)
+	f, err := fn.newWithRuntime(r)
+	if err != nil {
+		return nil, fmt.Errorf("function init failed: %v", err)
+	}
+	defer f.Close()
+
+	f.Cold = true
+	return invokeFunction(ctx, f, payload)
+}
+
+// acquire takes concurrency slot of function, waiting at most queueWait.
+func (reg *registry) acquire(ctx context.Context, fn *function) error {
+	if fn.sem.TryAcquire(1) {
+		return nil
+	}
+	if reg.queueWait > 0 {
+		wctx, cancel := context.WithTimeout(ctx, reg.queueWait)
+		defer cancel()
+		if err := fn.sem.Acquire(wctx, 1); err == nil {
+			return nil
+		} else if ctx.Err() != nil {
+			return err
+		}
+	}
+	if fn.sem != reg.sem {
+		return errReservedThrottled
+	}
+	return errThrottled
+}
+
+func invokeFunction(ctx context.Context, f *subslicer.Function, payload []byte) ([]byte, error) {
+	defer f.Reset()
+
+	if len(payload) == 0 {
+		payload = []byte("{}")
+	}
+	if _, err := f.Write(payload); err != nil {
+		return nil, err
+	}
+
+	if err := f.Thaw(); err != nil {
+		return nil, fmt.Errorf("thaw failed: %v", err)
+	}
+
+	switch err := f.Invoke(ctx); err {
+	case nil:
+	case subslicer.ErrHandlerError, subslicer.ErrHandlerFault:
+		// response lives in shared memory, copy it before reset
+		return append([]byte(nil), f.Response()...), errFunctionError
+	default:
+		return nil, fmt.Errorf("invoke failed: %v", err)
+	}
+
+	if err := f.Freeze(); err != nil {
+		return nil, fmt.Errorf("freeze failed: %v", err)
+	}
+
+	if *debug {
+		debug := string(f.Debug())
+		if len(debug) > 0 && debug != "{}" {
+			log.Println(len(debug), debug)
+		}
+	}
+
+	return append([]byte(nil), f.Response()...), nil
+}
+
+// Prewarm starts provisioned instances of all functions in parallel.
+func (reg *registry) Prewarm() {
+	var wg sync.WaitGroup
+	for _, fn := range reg.functions {
+		wg.Add(1)
+		go func(fn *function) {
+			defer wg.Done()
+			reg.prewarm(fn)
+		}(fn)
+	}
+	wg.Wait()
+}
+
+func (reg *registry) prewarm(fn *function) {
+	n, err := fn.pool.Prewarm()
+	if n > 0 {
+		log.Println("Prewarmed lambda function:", fn.Name, n)
+	}
+	if err != nil {
+		log.Println(fn.Name, err)
+	}
+}
+
+// Reaper periodically closes idle instances over limits of functions,
+// provisioned instances are replaced.
+func (reg *registry) Reaper(interval time.Duration) error {
+	for range time.Tick(interval) {
+		for _, fn := range reg.functions {
+			n, err := fn.pool.Reap()
+			if err != nil {
+				log.Println(fn.Name, err)
+			}
+			if n > 0 {
+				log.Println("Recycled lambda function:", fn.Name, n)
+				go reg.prewarm(fn)
+			}
+			if fn.pool.Draining() == 0 {
+				reg.removeStale(fn)
+			}
+		}
+	}
+	return nil
+}
+
+// Reload starts new generation of function instances, instances serving
+// invocations are closed when done.
+func (reg *registry) Reload(fn *function) {
+	old := fn.codeDir()
+	if fn.Zip != "" || len(fn.Layers) > 0 {
+		if err := fn.update(); err != nil {
+			log.Println("Reload failed, serving previous package and layers of", fn.Name, err)
+			return
+		}
+	}
+	if err := fn.pool.Purge(); err != nil {
+		log.Println(fn.Name, err)
+	}
+	if fn.Zip != "" && fn.codeDir() != old {
+		// instances of previous generation may still use it
+		fn.m.Lock()
+		fn.stale = append(fn.stale, old)
+		fn.m.Unlock()
+	}
+	log.Println("Reloaded lambda function:", fn.Name,
+		"generation", fn.pool.Generation(), "draining", fn.pool.Draining())
+	reg.prewarm(fn)
+}
+
+// Purge closes idle instances of all functions.
+func (reg *registry) Purge() {
+	for _, fn := range reg.functions {
+		if err := fn.pool.Purge(); err != nil {
+			log.Println(fn.Name, err)
+		}
+	}
+}
+
+// functionArn returns unqualified arn of function by name.
+func functionArn(name string) string {
+	return fmt.Sprintf("arn:aws:lambda:%s:%s:function:%s", *region, accountID, name)
+}
+
+// requestID returns random id in lambda request id format.
+func requestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	s := hex.EncodeToString(b[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// s3Bucket watches local directory mapped to bucket and sends S3 event
+// notifications to functions asynchronously. Files are object keys
+// relative to the directory, subdirectories are watched as well.
+type s3Bucket struct {
+	*BucketConfig
+	reg   *registry
+	queue *asyncQueue
+
+	watcher *fsnotify.Watcher
+
+	m       sync.Mutex
+	pending map[string]*time.Timer
+	// objects are keys of files in directory, removed directory is
+	// reported as removal of objects inside
+	objects  map[string]bool
+	sequence int64
+}
+
+func newS3Bucket(reg *registry, queue *asyncQueue, config *BucketConfig) (*s3Bucket, error) {
+	for _, nc := range config.Notifications {
+		if _, ok := reg.Lookup(nc.FunctionName); !ok {
+			return nil, fmt.Errorf("bucket %s: unknown function: %s", config.Name, nc.FunctionName)
+		}
+		for _, e := range nc.Events {
+			if !strings.HasPrefix(e, "s3:ObjectCreated:") && !strings.HasPrefix(e, "s3:ObjectRemoved:") {
+				return nil, fmt.Errorf("bucket %s: unsupported event: %s", config.Name, e)
+			}
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	b := &s3Bucket{
+		BucketConfig: config,
+		reg:          reg,
+		queue:        queue,
+		watcher:      watcher,
+		pending:      make(map[string]*time.Timer),
+		objects:      make(map[string]bool),
+	}
+	if err := b.watch(b.Path); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	// existing files are objects of bucket
+	filepath.Walk(b.Path, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			key, _ := filepath.Rel(b.Path, path)
+			b.objects[filepath.ToSlash(key)] = true
+		}
+		return nil
+	})
+	return b, nil
+}
+
+// watch adds dir and its subdirectories to watcher.
+func (b *s3Bucket) watch(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return b.watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+func (b *s3Bucket) Serve() error {
+	for {
+		select {
+		case event, ok := <-b.watcher.Events:
+			if !ok {
+				return nil
+			}
+			b.handle(event)
+		case err, ok := <-b.watcher.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (b *s3Bucket) handle(event fsnotify.Event) {
+	key, err := filepath.Rel(b.Path, event.Name)
+	if err != nil {
+		log.Println("s3:", err)
+		return
+	}
+	key = filepath.ToSlash(key)
+
+	switch {
+	case event.Op&fsnotify.Create != 0:
+		info, err := os.Stat(event.Name)
+		if err != nil {
+			return
+		}
+		if info.IsDir() {
+			// files created before the watch was added are reported
+			// as new objects
+			if err := b.watch(event.Name); err != nil {
+				log.Println("s3:", err)
+			}
+			filepath.Walk(event.Name, func(path string, info os.FileInfo, err error) error {
+				if err == nil && info.Mode().IsRegular() {
+					b.handle(fsnotify.Event{Name: path, Op: fsnotify.Write})
+				}
+				return nil
+			})
+			return
+		}
+		b.created(key, event.Name)
+
+	case event.Op&fsnotify.Write != 0:
+		b.created(key, event.Name)
+
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		// key is file or directory with objects inside
+		inside := func(k string) bool {
+			return k == key || strings.HasPrefix(k, key+"/")
+		}
+		var removed []string
+		b.m.Lock()
+		for k, t := range b.pending {
+			if inside(k) {
+				t.Stop()
+				delete(b.pending, k)
+			}
+		}
+		for k := range b.objects {
+			if inside(k) {
+				removed = append(removed, k)
+				delete(b.objects, k)
+			}
+		}
+		b.m.Unlock()
+		sort.Strings(removed)
+		for _, k := range removed {
+			b.notify("ObjectRemoved:Delete", k, nil)
+		}
+	}
+}
+
+// created debounces writes of the same file, object is put once the file
+// is no longer written.
+func (b *s3Bucket) created(key, path string) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if t, ok := b.pending[key]; ok {
+		t.Reset(200 * time.Millisecond)
+		return
+	}
+	b.pending[key] = time.AfterFunc(200*time.Millisecond, func() {
+		b.m.Lock()
+		delete(b.pending, key)
+		b.m.Unlock()
+
+		object, err := s3Object(path)
+		if err != nil {
+			log.Println("s3:", err)
+			return
+		}
+		b.m.Lock()
+		b.objects[key] = true
+		b.m.Unlock()
+		b.notify("ObjectCreated:Put", key, object)
+	})
+}
+
+// s3Object returns size and etag of object stored in file.
+func s3Object(path string) (map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"size": size,
+		"eTag": hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// notify sends event to functions of matching notification configurations.
+func (b *s3Bucket) notify(eventName, key string, object map[string]interface{}) {
+	b.m.Lock()
+	b.sequence++
+	sequencer := fmt.Sprintf("%016X", b.sequence)
+	b.m.Unlock()
+
+	for _, nc := range b.Notifications {
+		if !nc.match(eventName, key) {
+			continue
+		}
+
+		obj := map[string]interface{}{
+			"key":       s3EscapeKey(key),
+			"sequencer": sequencer,
+		}
+		for k, v := range object {
+			obj[k] = v
+		}
+		record := map[string]interface{}{
+			"eventVersion": "2.1",
+			"eventSource":  "aws:s3",
+			"awsRegion":    *region,
+			"eventTime":    time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+			"eventName":    eventName,
+			"userIdentity": map[string]string{
+				"principalId": "AWS:" + accountID,
+			},
+			"requestParameters": map[string]string{
+				"sourceIPAddress": "127.0.0.1",
+			},
+			"responseElements": map[string]string{
+				"x-amz-request-id": sequencer,
+				"x-amz-id-2":       requestID(),
+			},
+			"s3": map[string]interface{}{
+				"s3SchemaVersion": "1.0",
+				"configurationId": nc.ID,
+				"bucket": map[string]interface{}{
+					"name":          b.Name,
+					"ownerIdentity": map[string]string{"principalId": accountID},
+					"arn":           "arn:aws:s3:::" + b.Name,
+				},
+				"object": obj,
+			},
+		}
+
+		payload, err := json.Marshal(map[string]interface{}{
+			"Records": []interface{}{record},
+		})
+		if err != nil {
+			log.Println("s3:", err)
+			continue
+		}
+		fn, _ := b.reg.Lookup(nc.FunctionName)
+		if _, err := b.queue.Enqueue(fn.Name, payload, ""); err != nil {
+			log.Println("s3:", err)
+		}
+	}
+}
+
+// match reports whether notification configuration selects event for key.
+func (nc *NotificationConfig) match(eventName, key string) bool {
+	if !strings.HasPrefix(key, nc.Filter.Prefix) || !strings.HasSuffix(key, nc.Filter.Suffix) {
+		return false
+	}
+	for _, e := range nc.Events {
+		e = strings.TrimPrefix(e, "s3:")
+		if e == eventName || (strings.HasSuffix(e, ":*") && strings.HasPrefix(eventName, e[:len(e)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// s3EscapeKey encodes key like S3 does in event notifications.
+func s3EscapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i := range parts {
+		parts[i] = url.QueryEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// schedule returns next activation time after t.
+type schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// parseSchedule parses EventBridge schedule expression, rate(value unit)
+// or cron(minutes hours day-of-month month day-of-week year).
+func parseSchedule(expr string) (schedule, error) {
+	expr = strings.TrimSpace(expr)
+	switch {
+	case strings.HasPrefix(expr, "rate(") && strings.HasSuffix(expr, ")"):
+		return parseRate(expr[len("rate(") : len(expr)-1])
+	case strings.HasPrefix(expr, "cron(") && strings.HasSuffix(expr, ")"):
+		return parseCron(expr[len("cron(") : len(expr)-1])
+	}
+	return nil, fmt.Errorf("invalid schedule expression: %s", expr)
+}
+
+type rateSchedule time.Duration
+
+func parseRate(expr string) (schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid rate expression: %s", expr)
+	}
+	value, err := strconv.Atoi(fields[0])
+	if err != nil || value <= 0 {
+		return nil, fmt.Errorf("invalid rate value: %s", fields[0])
+	}
+	var unit time.Duration
+	switch strings.TrimSuffix(fields[1], "s") {
+	case "minute":
+		unit = time.Minute
+	case "hour":
+		unit = time.Hour
+	case "day":
+		unit = 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("invalid rate unit: %s", fields[1])
+	}
+	return rateSchedule(time.Duration(value) * unit), nil
+}
+
+func (r rateSchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(r)).Truncate(time.Second)
+}
+
+// cronSchedule matches times in UTC, each field is a set of allowed values.
+// Day-of-month or day-of-week is nil when given as ?.
+type cronSchedule struct {
+	minutes, hours, dom, months, dow, years map[int]bool
+}
+
+var (
+	cronMonths = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+	cronDays   = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+)
+
+func parseCron(expr string) (schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid cron expression, 6 fields required: %s", expr)
+	}
+	if (fields[2] == "?") == (fields[4] == "?") {
+		return nil, errors.New("invalid cron expression, one of day-of-month or day-of-week must be ?")
+	}
+
+	var c cronSchedule
+	var err error
+	if c.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if c.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if c.months, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 1, 7, cronDays); err != nil {
+		return nil, err
+	}
+	if c.years, err = parseCronField(fields[5], 1970, 2199, nil); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// parseCronField parses lists of values, ranges and increments, names are
+// matched case insensitive and start at min.
+func parseCronField(field string, min, max int, names []string) (map[int]bool, error) {
+	if field == "?" {
+		return nil, nil
+	}
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return min + i, nil
+			}
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil || v < min || v > max {
+			// L, W and # wildcards are not supported
+			return 0, fmt.Errorf("invalid or unsupported cron value: %s", s)
+		}
+		return v, nil
+	}
+
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid cron increment: %s", part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.IndexByte(part, '-') > 0:
+			i := strings.IndexByte(part, '-')
+			var err error
+			if lo, err = value(part[:i]); err != nil {
+				return nil, err
+			}
+			if hi, err = value(part[i+1:]); err != nil {
+				return nil, err
+			}
+		default:
+			var err error
+			if lo, err = value(part); err != nil {
+				return nil, err
+			}
+			if step == 1 {
+				hi = lo
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !c.years[t.Year()]:
+			t = time.Date(t.Year()+1, 1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.months[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.day(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case !c.hours[t.Hour()]:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case !c.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	// never fires
+	return time.Time{}
+}
+
+func (c *cronSchedule) day(t time.Time) bool {
+	if c.dom != nil {
+		return c.dom[t.Day()]
+	}
+	// day-of-week 1 is sunday
+	return c.dow[int(t.Weekday())+1]
+}
+
+// scheduleRule is EventBridge schedule rule with single function target.
+type scheduleRule struct {
+	*ScheduleConfig
+	function string
+	schedule schedule
+	trigger  chan struct{}
+
+	m    sync.Mutex
+	next time.Time
+}
+
+// scheduler invokes functions asynchronously with scheduled events.
+type scheduler struct {
+	queue *asyncQueue
+	rules map[string]*scheduleRule
+	order []string
+}
+
+func newScheduler(reg *registry, queue *asyncQueue) (*scheduler, error) {
+	s := &scheduler{
+		queue: queue,
+		rules: make(map[string]*scheduleRule),
+	}
+	for _, fn := range reg.Functions() {
+		for _, sc := range fn.Schedules {
+			if _, ok := s.rules[sc.Name]; ok {
+				return nil, fmt.Errorf("duplicate schedule rule: %s", sc.Name)
+			}
+			sched, err := parseSchedule(sc.ScheduleExpression)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", sc.Name, err)
+			}
+			s.rules[sc.Name] = &scheduleRule{
+				ScheduleConfig: sc,
+				function:       fn.Name,
+				schedule:       sched,
+				trigger:        make(chan struct{}, 1),
+			}
+			s.order = append(s.order, sc.Name)
+		}
+	}
+	return s, nil
+}
+
+func (s *scheduler) Serve() error {
+	for _, name := range s.order {
+		go s.serveRule(s.rules[name])
+	}
+	select {}
+}
+
+func (s *scheduler) serveRule(r *scheduleRule) {
+	next := r.schedule.Next(time.Now())
+	for !next.IsZero() {
+		r.m.Lock()
+		r.next = next
+		r.m.Unlock()
+
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-t.C:
+		case <-r.trigger:
+			t.Stop()
+			log.Println("schedule: fast-forward", r.Name, next.Format(time.RFC3339))
+		}
+		s.fire(r, next)
+
+		// fast-forwarded run moves the schedule forward as well
+		now := time.Now()
+		if next.Before(now) {
+			next = now
+		}
+		next = r.schedule.Next(next)
+	}
+	log.Println("schedule: rule never fires", r.Name)
+}
+
+// Run triggers next scheduled run of rule immediately.
+func (s *scheduler) Run(name string) bool {
+	r, ok := s.rules[name]
+	if !ok {
+		return false
+	}
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (s *scheduler) fire(r *scheduleRule, t time.Time) {
+	payload := []byte(r.Input)
+	if len(payload) == 0 {
+		event := map[string]interface{}{
+			"version":     "0",
+			"id":          requestID(),
+			"detail-type": "Scheduled Event",
+			"source":      "aws.events",
+			"account":     accountID,
+			"time":        t.UTC().Format(time.RFC3339),
+			"region":      *region,
+			"resources":   []string{r.arn()},
+			"detail":      map[string]interface{}{},
+		}
+		var err error
+		if payload, err = json.Marshal(event); err != nil {
+			log.Println("schedule:", err)
+			return
+		}
+	}
+	if _, err := s.queue.Enqueue(r.function, payload, ""); err != nil {
+		log.Println("schedule:", err)
+	}
+}
+
+func (r *scheduleRule) arn() string {
+	return fmt.Sprintf("arn:aws:events:%s:%s:rule/%s", *region, accountID, r.Name)
+}
+
+// Rules returns rules with their next activation time.
+func (s *scheduler) Rules() []map[string]interface{} {
+	var rules []map[string]interface{}
+	for _, name := range s.order {
+		r := s.rules[name]
+		r.m.Lock()
+		rules = append(rules, map[string]interface{}{
+			"name":               r.Name,
+			"arn":                r.arn(),
+			"scheduleExpression": r.ScheduleExpression,
+			"function":           r.function,
+			"next":               r.next.UTC().Format(time.RFC3339),
+		})
+		r.m.Unlock()
+	}
+	return rules
+}
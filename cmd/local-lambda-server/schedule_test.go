@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// monday
+	now := time.Date(2024, 1, 15, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"rate(1 minute)", time.Date(2024, 1, 15, 10, 8, 30, 0, time.UTC)},
+		{"rate(5 minutes)", time.Date(2024, 1, 15, 10, 12, 30, 0, time.UTC)},
+		{"rate(1 hour)", time.Date(2024, 1, 15, 11, 7, 30, 0, time.UTC)},
+		{"rate(2 days)", time.Date(2024, 1, 17, 10, 7, 30, 0, time.UTC)},
+		{"cron(0 12 * * ? *)", time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)},
+		{"cron(0/15 * * * ? *)", time.Date(2024, 1, 15, 10, 15, 0, 0, time.UTC)},
+		{"cron(7 10 * * ? *)", time.Date(2024, 1, 16, 10, 7, 0, 0, time.UTC)},
+		{"cron(0 8 ? * MON-FRI *)", time.Date(2024, 1, 16, 8, 0, 0, 0, time.UTC)},
+		{"cron(0 8 ? * sat *)", time.Date(2024, 1, 20, 8, 0, 0, 0, time.UTC)},
+		{"cron(0 8 ? * 1 *)", time.Date(2024, 1, 21, 8, 0, 0, 0, time.UTC)},
+		{"cron(0 0 1 * ? *)", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"cron(30 9 29 FEB ? *)", time.Date(2024, 2, 29, 9, 30, 0, 0, time.UTC)},
+		{"cron(0 9,17 * * ? *)", time.Date(2024, 1, 15, 17, 0, 0, 0, time.UTC)},
+		{"cron(10 10 15 1 ? 2025)", time.Date(2025, 1, 15, 10, 10, 0, 0, time.UTC)},
+		{"cron(0 0 1 1 ? 2023)", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.expr)
+		if err != nil {
+			t.Errorf("parseSchedule(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := s.Next(now); !got.Equal(tt.want) {
+			t.Errorf("%s: Next = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	tests := []string{
+		"every 5 minutes",
+		"rate(5)",
+		"rate(0 minutes)",
+		"rate(-1 hours)",
+		"rate(5 weeks)",
+		"cron(0 12 * *)",
+		"cron(0 12 * * * *)",
+		"cron(0 12 ? * ? *)",
+		"cron(60 * * * ? *)",
+		"cron(0 24 * * ? *)",
+		"cron(0 12 L * ? *)",
+		"cron(0 12 ? * 6#3 *)",
+		"cron(0/0 * * * ? *)",
+		"cron(0 12 * FOO ? *)",
+	}
+	for _, expr := range tests {
+		if _, err := parseSchedule(expr); err == nil {
+			t.Errorf("parseSchedule(%q): expected error", expr)
+		}
+	}
+}
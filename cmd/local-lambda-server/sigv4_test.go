@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test vectors from AWS Signature Version 4 test suite.
+func TestSignV4(t *testing.T) {
+	creds := &awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		header  map[string]string
+		body    string
+		headers string
+		sig     string
+	}{
+		{
+			name:    "get-vanilla",
+			method:  "GET",
+			url:     "https://example.amazonaws.com/",
+			headers: "host;x-amz-date",
+			sig:     "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:    "get-vanilla-query-order-key-case",
+			method:  "GET",
+			url:     "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			headers: "host;x-amz-date",
+			sig:     "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name:    "get-vanilla-empty-query-key",
+			method:  "GET",
+			url:     "https://example.amazonaws.com/?Param1=value1",
+			headers: "host;x-amz-date",
+			sig:     "a67d582fa61cc504c4bae71f336f98b97f1ea3c7a6bfe1b6e45aec72011b9aeb",
+		},
+		{
+			name:    "post-vanilla",
+			method:  "POST",
+			url:     "https://example.amazonaws.com/",
+			headers: "host;x-amz-date",
+			sig:     "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name:    "post-x-www-form-urlencoded",
+			method:  "POST",
+			url:     "https://example.amazonaws.com/",
+			header:  map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			body:    "Param1=value1",
+			headers: "content-type;host;x-amz-date",
+			sig:     "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		signV4(req, []byte(tt.body), creds, "us-east-1", "service", now)
+
+		want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=" + tt.headers + ", Signature=" + tt.sig
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("%s: Authorization = %s, want %s", tt.name, got, want)
+		}
+		if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+			t.Errorf("%s: X-Amz-Date = %s", tt.name, got)
+		}
+	}
+}
+
+func TestSignV4SessionToken(t *testing.T) {
+	creds := &awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		SessionToken:    "token",
+	}
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	signV4(req, nil, creds, "us-east-1", "service", time.Now())
+
+	if got := req.Header.Get("X-Amz-Security-Token"); got != "token" {
+		t.Errorf("X-Amz-Security-Token = %q", got)
+	}
+	if auth := req.Header.Get("Authorization"); !strings.Contains(auth, "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("token not signed: %s", auth)
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", ""},
+		{"b=2&a=1", "a=1&b=2"},
+		{"a=2&a=1", "a=1&a=2"},
+		{"a=x+y", "a=x%20y"},
+		{"a=%7E-_.", "a=~-_."},
+		{"a=%2F%3D", "a=%2F%3D"},
+		{"a", "a="},
+	}
+	for _, tt := range tests {
+		v, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := canonicalQuery(v); got != tt.want {
+			t.Errorf("canonicalQuery(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snsMessageAttribute is a message attribute in SNS api and envelope.
+type snsMessageAttribute struct {
+	Type  string
+	Value string
+}
+
+type snsMessage struct {
+	ID         string
+	TopicArn   string
+	Subject    string
+	Message    string
+	Attributes map[string]snsMessageAttribute
+	Timestamp  time.Time
+
+	// trace is X-Amzn-Trace-Id of publisher
+	trace string
+	// messages is set for MessageStructure json, keyed by protocol
+	messages map[string]string
+}
+
+// body returns message delivered to protocol.
+func (m *snsMessage) body(protocol string) string {
+	if m.messages == nil {
+		return m.Message
+	}
+	if s, ok := m.messages[protocol]; ok {
+		return s
+	}
+	return m.messages["default"]
+}
+
+// envelope returns SNS notification of message.
+func (m *snsMessage) envelope(subscriptionArn, protocol string) map[string]interface{} {
+	attributes := make(map[string]interface{})
+	for k, v := range m.Attributes {
+		attributes[k] = v
+	}
+	var subject interface{}
+	if m.Subject != "" {
+		subject = m.Subject
+	}
+	return map[string]interface{}{
+		"Type":              "Notification",
+		"MessageId":         m.ID,
+		"TopicArn":          m.TopicArn,
+		"Subject":           subject,
+		"Message":           m.body(protocol),
+		"Timestamp":         m.Timestamp.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"SignatureVersion":  "1",
+		"Signature":         "EXAMPLE",
+		"SigningCertUrl":    "EXAMPLE",
+		"UnsubscribeUrl":    "EXAMPLE?Action=Unsubscribe&SubscriptionArn=" + subscriptionArn,
+		"MessageAttributes": attributes,
+	}
+}
+
+// filterValues returns message attributes decoded for filter policy
+// matching, binary attributes are never matched.
+func (m *snsMessage) filterValues() map[string]interface{} {
+	values := make(map[string]interface{})
+	for k, v := range m.Attributes {
+		switch v.Type {
+		case "String":
+			values[k] = v.Value
+		case "Number":
+			if n, err := strconv.ParseFloat(v.Value, 64); err == nil {
+				values[k] = n
+			}
+		case "String.Array":
+			var array []interface{}
+			if err := json.Unmarshal([]byte(v.Value), &array); err == nil {
+				values[k] = array
+			}
+		}
+	}
+	return values
+}
+
+type snsSubscription struct {
+	*SubscriptionConfig
+	arn    string
+	policy eventPattern
+}
+
+// match reports whether message passes subscription filter policy.
+func (s *snsSubscription) match(m *snsMessage) bool {
+	if s.policy == nil {
+		return true
+	}
+	if s.FilterPolicyScope == "MessageBody" {
+		var body map[string]interface{}
+		if err := json.Unmarshal([]byte(m.body(s.Protocol)), &body); err != nil {
+			return false
+		}
+		return s.policy.Match(body)
+	}
+	return s.policy.Match(m.filterValues())
+}
+
+type snsTopic struct {
+	*TopicConfig
+	arn           string
+	subscriptions []*snsSubscription
+}
+
+// snsBroker serves SNS Publish api and fans out messages to subscribed
+// functions, invoked asynchronously, and queues.
+type snsBroker struct {
+	reg    *registry
+	queue  *asyncQueue
+	sqs    *sqsBroker
+	topics map[string]*snsTopic
+}
+
+func newSNSBroker(reg *registry, queue *asyncQueue, sqs *sqsBroker, configs []*TopicConfig) (*snsBroker, error) {
+	b := &snsBroker{
+		reg:    reg,
+		queue:  queue,
+		sqs:    sqs,
+		topics: make(map[string]*snsTopic),
+	}
+	for _, tc := range configs {
+		if _, ok := b.topics[tc.Name]; ok {
+			return nil, fmt.Errorf("duplicate topic: %s", tc.Name)
+		}
+		t := &snsTopic{
+			TopicConfig: tc,
+			arn:         fmt.Sprintf("arn:aws:sns:%s:%s:%s", *region, accountID, tc.Name),
+		}
+		for _, sc := range tc.Subscriptions {
+			switch sc.Protocol {
+			case "lambda":
+				if _, ok := reg.Lookup(sc.Endpoint); !ok {
+					return nil, fmt.Errorf("topic %s: unknown function: %s", tc.Name, sc.Endpoint)
+				}
+			case "sqs":
+				if _, ok := sqs.Lookup(sc.Endpoint); !ok {
+					return nil, fmt.Errorf("topic %s: unknown queue: %s", tc.Name, sc.Endpoint)
+				}
+			default:
+				return nil, fmt.Errorf("topic %s: unsupported protocol: %s", tc.Name, sc.Protocol)
+			}
+			if sc.FilterPolicyScope != "MessageAttributes" && sc.FilterPolicyScope != "MessageBody" {
+				return nil, fmt.Errorf("topic %s: invalid filter policy scope: %s", tc.Name, sc.FilterPolicyScope)
+			}
+
+			s := &snsSubscription{
+				SubscriptionConfig: sc,
+				arn:                t.arn + ":" + requestID(),
+			}
+			if len(sc.FilterPolicy) > 0 {
+				policy, err := parseEventPattern(sc.FilterPolicy)
+				if err != nil {
+					return nil, fmt.Errorf("topic %s: filter policy: %v", tc.Name, err)
+				}
+				s.policy = policy
+			}
+			t.subscriptions = append(t.subscriptions, s)
+		}
+		b.topics[tc.Name] = t
+	}
+	return b, nil
+}
+
+// Lookup returns topic by name or arn.
+func (b *snsBroker) Lookup(name string) (*snsTopic, bool) {
+	if i := strings.LastIndexByte(name, ':'); i >= 0 {
+		name = name[i+1:]
+	}
+	t, ok := b.topics[name]
+	return t, ok
+}
+
+// Publish delivers message to subscriptions of topic with matching filter
+// policies.
+func (b *snsBroker) Publish(t *snsTopic, m *snsMessage) {
+	for _, s := range t.subscriptions {
+		if !s.match(m) {
+			continue
+		}
+
+		switch s.Protocol {
+		case "lambda":
+			event := map[string]interface{}{
+				"Records": []interface{}{
+					map[string]interface{}{
+						"EventVersion":         "1.0",
+						"EventSubscriptionArn": s.arn,
+						"EventSource":          "aws:sns",
+						"Sns":                  m.envelope(s.arn, s.Protocol),
+					},
+				},
+			}
+			payload, err := json.Marshal(event)
+			if err != nil {
+				log.Println("sns:", err)
+				continue
+			}
+			fn, _ := b.reg.Lookup(s.Endpoint)
+			if _, err := b.queue.Enqueue(fn.Name, payload, m.trace); err != nil {
+				log.Println("sns:", err)
+			}
+
+		case "sqs":
+			q, _ := b.sqs.Lookup(s.Endpoint)
+			if s.RawMessageDelivery {
+				q.Send(m.body(s.Protocol), sqsAttributes(m.Attributes), 0, m.trace)
+				continue
+			}
+			body, err := json.Marshal(m.envelope(s.arn, s.Protocol))
+			if err != nil {
+				log.Println("sns:", err)
+				continue
+			}
+			q.Send(string(body), nil, 0, m.trace)
+		}
+	}
+}
+
+// sqsAttributes converts message attributes for raw message delivery.
+func sqsAttributes(attributes map[string]snsMessageAttribute) map[string]sqsMessageAttribute {
+	m := make(map[string]sqsMessageAttribute)
+	for k, v := range attributes {
+		a := sqsMessageAttribute{DataType: v.Type}
+		if v.Type == "Binary" {
+			a.BinaryValue, _ = base64.StdEncoding.DecodeString(v.Value)
+		} else {
+			value := v.Value
+			a.StringValue = &value
+		}
+		m[k] = a
+	}
+	return m
+}
+
+// ServeHTTP serves Publish and ListTopics using query protocol.
+func (b *snsBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeSNSError(w, http.StatusBadRequest, "InvalidParameter", err.Error())
+		return
+	}
+
+	switch action := r.Form.Get("Action"); action {
+	case "ListTopics":
+		var result struct {
+			Topics []struct {
+				TopicArn string
+			} `xml:"Topics>member"`
+		}
+		for _, t := range b.topics {
+			result.Topics = append(result.Topics, struct{ TopicArn string }{t.arn})
+		}
+		writeSNSResponse(w, action, result)
+
+	case "Publish":
+		arn := r.Form.Get("TopicArn")
+		if arn == "" {
+			arn = r.Form.Get("TargetArn")
+		}
+		t, ok := b.Lookup(arn)
+		if !ok {
+			writeSNSError(w, http.StatusNotFound, "NotFound", "Topic does not exist")
+			return
+		}
+
+		m := &snsMessage{
+			ID:         requestID(),
+			TopicArn:   t.arn,
+			Subject:    r.Form.Get("Subject"),
+			Message:    r.Form.Get("Message"),
+			Attributes: make(map[string]snsMessageAttribute),
+			Timestamp:  time.Now(),
+			trace:      r.Header.Get("X-Amzn-Trace-Id"),
+		}
+		if m.Message == "" {
+			writeSNSError(w, http.StatusBadRequest, "InvalidParameter", "Empty message")
+			return
+		}
+		if r.Form.Get("MessageStructure") == "json" {
+			if err := json.Unmarshal([]byte(m.Message), &m.messages); err != nil {
+				writeSNSError(w, http.StatusBadRequest, "InvalidParameter", "Message Structure - JSON message body failed to parse")
+				return
+			}
+			if _, ok := m.messages["default"]; !ok {
+				writeSNSError(w, http.StatusBadRequest, "InvalidParameter", "Message Structure - No default entry in JSON message body")
+				return
+			}
+		}
+		for i := 1; ; i++ {
+			prefix := fmt.Sprintf("MessageAttributes.entry.%d.", i)
+			name := r.Form.Get(prefix + "Name")
+			if name == "" {
+				break
+			}
+			a := snsMessageAttribute{Type: r.Form.Get(prefix + "Value.DataType")}
+			if strings.HasPrefix(a.Type, "Binary") {
+				a.Type = "Binary"
+				a.Value = r.Form.Get(prefix + "Value.BinaryValue")
+			} else {
+				a.Value = r.Form.Get(prefix + "Value.StringValue")
+			}
+			m.Attributes[name] = a
+		}
+
+		b.Publish(t, m)
+		writeSNSResponse(w, action, struct{ MessageId string }{m.ID})
+
+	default:
+		writeSNSError(w, http.StatusBadRequest, "InvalidAction", "Unsupported action: "+action)
+	}
+}
+
+func writeSNSResponse(w http.ResponseWriter, action string, result interface{}) {
+	w.Header().Set("Content-Type", "text/xml")
+
+	// response and result elements are named after action
+	start := xml.StartElement{
+		Name: xml.Name{Local: action + "Response"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: "http://sns.amazonaws.com/doc/2010-03-31/"}},
+	}
+	metadata := struct{ RequestId string }{requestID()}
+
+	enc := xml.NewEncoder(w)
+	enc.EncodeToken(start)
+	enc.EncodeElement(result, xml.StartElement{Name: xml.Name{Local: action + "Result"}})
+	enc.EncodeElement(metadata, xml.StartElement{Name: xml.Name{Local: "ResponseMetadata"}})
+	enc.EncodeToken(start.End())
+	enc.Flush()
+}
+
+func writeSNSError(w http.ResponseWriter, status int, code, message string) {
+	var resp struct {
+		XMLName xml.Name `xml:"ErrorResponse"`
+		Error   struct {
+			Type    string
+			Code    string
+			Message string
+		}
+		RequestId string
+	}
+	resp.Error.Type = "Sender"
+	resp.Error.Code = code
+	resp.Error.Message = message
+	resp.RequestId = requestID()
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(resp)
+}
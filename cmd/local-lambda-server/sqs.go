@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dzeromsk/subslicer"
+)
+
+// sqsMessageAttribute is a message attribute in SQS api and event shape.
+type sqsMessageAttribute struct {
+	DataType         string   `json:"dataType"`
+	StringValue      *string  `json:"stringValue,omitempty"`
+	BinaryValue      []byte   `json:"binaryValue,omitempty"`
+	StringListValues []string `json:"stringListValues"`
+	BinaryListValues [][]byte `json:"binaryListValues"`
+}
+
+type sqsMessage struct {
+	ID                string
+	Body              string
+	MessageAttributes map[string]sqsMessageAttribute
+	SentTimestamp     time.Time
+	FirstReceived     time.Time
+	ReceiveCount      int
+	TraceHeader       string
+
+	visibleAt     time.Time
+	receiptHandle string
+}
+
+func (m *sqsMessage) md5OfBody() string {
+	sum := md5.Sum([]byte(m.Body))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *sqsMessage) attributes() map[string]string {
+	attributes := map[string]string{
+		"ApproximateReceiveCount": strconv.Itoa(m.ReceiveCount),
+		"SentTimestamp":           strconv.FormatInt(m.SentTimestamp.UnixNano()/1e6, 10),
+		"SenderId":                accountID,
+	}
+	if !m.FirstReceived.IsZero() {
+		attributes["ApproximateFirstReceiveTimestamp"] = strconv.FormatInt(m.FirstReceived.UnixNano()/1e6, 10)
+	}
+	if m.TraceHeader != "" {
+		attributes["AWSTraceHeader"] = m.TraceHeader
+	}
+	return attributes
+}
+
+// sqsQueue is an in-process queue with SQS visibility timeout and redrive
+// semantics.
+type sqsQueue struct {
+	*QueueConfig
+	dlq *sqsQueue
+
+	m        sync.Mutex
+	messages []*sqsMessage
+	notify   chan struct{}
+}
+
+func newSQSQueue(config *QueueConfig) *sqsQueue {
+	return &sqsQueue{
+		QueueConfig: config,
+		notify:      make(chan struct{}),
+	}
+}
+
+func (q *sqsQueue) arn() string {
+	return fmt.Sprintf("arn:aws:sqs:%s:%s:%s", *region, accountID, q.Name)
+}
+
+// Send appends message to queue and wakes up receivers, trace is trace
+// header of sender.
+func (q *sqsQueue) Send(body string, attributes map[string]sqsMessageAttribute, delay time.Duration, trace string) *sqsMessage {
+	now := time.Now()
+	msg := &sqsMessage{
+		ID:                requestID(),
+		Body:              body,
+		MessageAttributes: attributes,
+		SentTimestamp:     now,
+		TraceHeader:       trace,
+		visibleAt:         now.Add(delay),
+	}
+
+	q.m.Lock()
+	q.messages = append(q.messages, msg)
+	close(q.notify)
+	q.notify = make(chan struct{})
+	q.m.Unlock()
+	return msg
+}
+
+// Receive returns up to max visible messages and hides them for
+// visibility timeout. Messages received more than maxReceiveCount times
+// are moved to dead-letter queue instead.
+func (q *sqsQueue) Receive(max int, visibility time.Duration) []*sqsMessage {
+	if visibility < 0 {
+		visibility = time.Duration(q.VisibilityTimeout) * time.Second
+	}
+
+	var received, dead []*sqsMessage
+	now := time.Now()
+
+	q.m.Lock()
+	kept := q.messages[:0]
+	for _, msg := range q.messages {
+		if len(received) >= max || now.Before(msg.visibleAt) {
+			kept = append(kept, msg)
+			continue
+		}
+		if q.dlq != nil && q.RedrivePolicy.MaxReceiveCount > 0 && msg.ReceiveCount >= q.RedrivePolicy.MaxReceiveCount {
+			dead = append(dead, msg)
+			continue
+		}
+		msg.ReceiveCount++
+		if msg.FirstReceived.IsZero() {
+			msg.FirstReceived = now
+		}
+		msg.visibleAt = now.Add(visibility)
+		msg.receiptHandle = requestID()
+		// receivers get snapshot, message may be received again once
+		// visibility timeout expires
+		snapshot := *msg
+		received = append(received, &snapshot)
+		kept = append(kept, msg)
+	}
+	q.messages = kept
+	q.m.Unlock()
+
+	for _, msg := range dead {
+		log.Println("sqs: moving message", msg.ID, "to", q.dlq.Name)
+		q.dlq.Send(msg.Body, msg.MessageAttributes, 0, msg.TraceHeader)
+	}
+
+	return received
+}
+
+// Wait blocks until message is sent to queue or timeout expires.
+func (q *sqsQueue) Wait(ctx context.Context, timeout time.Duration) {
+	q.m.Lock()
+	notify := q.notify
+	q.m.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-notify:
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// Delete removes message by receipt handle.
+func (q *sqsQueue) Delete(receiptHandle string) bool {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for i, msg := range q.messages {
+		if msg.receiptHandle == receiptHandle {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ChangeVisibility makes message by receipt handle visible after timeout.
+func (q *sqsQueue) ChangeVisibility(receiptHandle string, timeout time.Duration) bool {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for _, msg := range q.messages {
+		if msg.receiptHandle == receiptHandle {
+			msg.visibleAt = time.Now().Add(timeout)
+			return true
+		}
+	}
+	return false
+}
+
+// Purge removes all messages.
+func (q *sqsQueue) Purge() {
+	q.m.Lock()
+	q.messages = nil
+	q.m.Unlock()
+}
+
+// sqsBroker holds local queues and serves a subset of SQS api using json
+// protocol (X-Amz-Target: AmazonSQS.<Action>).
+type sqsBroker struct {
+	m      sync.Mutex
+	queues map[string]*sqsQueue
+}
+
+func newSQSBroker(configs []*QueueConfig) (*sqsBroker, error) {
+	b := &sqsBroker{queues: make(map[string]*sqsQueue)}
+	for _, qc := range configs {
+		if _, ok := b.queues[qc.Name]; ok {
+			return nil, fmt.Errorf("duplicate queue: %s", qc.Name)
+		}
+		b.queues[qc.Name] = newSQSQueue(qc)
+	}
+	for _, q := range b.queues {
+		if q.RedrivePolicy == nil {
+			continue
+		}
+		dlq, ok := b.Lookup(q.RedrivePolicy.DeadLetterTargetArn)
+		if !ok {
+			return nil, fmt.Errorf("dead-letter queue not found: %s", q.RedrivePolicy.DeadLetterTargetArn)
+		}
+		q.dlq = dlq
+	}
+	return b, nil
+}
+
+// Lookup returns queue by name, arn or url.
+func (b *sqsBroker) Lookup(name string) (*sqsQueue, bool) {
+	if i := strings.LastIndexAny(name, ":/"); i >= 0 {
+		name = name[i+1:]
+	}
+	b.m.Lock()
+	q, ok := b.queues[name]
+	b.m.Unlock()
+	return q, ok
+}
+
+func (b *sqsBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.Header.Get("X-Amz-Target")
+	if !strings.HasPrefix(target, "AmazonSQS.") {
+		writeSQSError(w, http.StatusBadRequest, "InvalidAction", "Only json protocol is supported")
+		return
+	}
+	action := strings.TrimPrefix(target, "AmazonSQS.")
+
+	var req struct {
+		QueueName             string
+		QueueUrl              string
+		QueueNamePrefix       string
+		MessageBody           string
+		MessageAttributes     map[string]sqsMessageAttribute
+		DelaySeconds          int
+		MaxNumberOfMessages   int
+		VisibilityTimeout     *int
+		WaitTimeSeconds       int
+		ReceiptHandle         string
+		AttributeNames        []string
+		MessageAttributeNames []string
+		Entries               []struct {
+			Id                string
+			MessageBody       string
+			MessageAttributes map[string]sqsMessageAttribute
+			DelaySeconds      int
+			ReceiptHandle     string
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeSQSError(w, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+
+	queueURL := func(q *sqsQueue) string {
+		return fmt.Sprintf("http://%s/%s/%s", r.Host, accountID, q.Name)
+	}
+
+	if action == "ListQueues" {
+		var urls []string
+		b.m.Lock()
+		for name, q := range b.queues {
+			if strings.HasPrefix(name, req.QueueNamePrefix) {
+				urls = append(urls, queueURL(q))
+			}
+		}
+		b.m.Unlock()
+		writeSQSResponse(w, map[string]interface{}{"QueueUrls": urls})
+		return
+	}
+
+	if action == "CreateQueue" {
+		b.m.Lock()
+		q, ok := b.queues[req.QueueName]
+		if !ok {
+			q = newSQSQueue(&QueueConfig{Name: req.QueueName, VisibilityTimeout: 30})
+			b.queues[req.QueueName] = q
+		}
+		b.m.Unlock()
+		writeSQSResponse(w, map[string]interface{}{"QueueUrl": queueURL(q)})
+		return
+	}
+
+	name := req.QueueUrl
+	if action == "GetQueueUrl" {
+		name = req.QueueName
+	}
+	q, ok := b.Lookup(name)
+	if !ok {
+		writeSQSError(w, http.StatusBadRequest, "AWS.SimpleQueueService.NonExistentQueue", "The specified queue does not exist.")
+		return
+	}
+
+	switch action {
+	case "GetQueueUrl":
+		writeSQSResponse(w, map[string]interface{}{"QueueUrl": queueURL(q)})
+
+	case "SendMessage":
+		msg := q.Send(req.MessageBody, req.MessageAttributes, time.Duration(req.DelaySeconds)*time.Second, r.Header.Get("X-Amzn-Trace-Id"))
+		writeSQSResponse(w, map[string]interface{}{
+			"MessageId":        msg.ID,
+			"MD5OfMessageBody": msg.md5OfBody(),
+		})
+
+	case "SendMessageBatch":
+		var successful []map[string]interface{}
+		for _, e := range req.Entries {
+			msg := q.Send(e.MessageBody, e.MessageAttributes, time.Duration(e.DelaySeconds)*time.Second, r.Header.Get("X-Amzn-Trace-Id"))
+			successful = append(successful, map[string]interface{}{
+				"Id":               e.Id,
+				"MessageId":        msg.ID,
+				"MD5OfMessageBody": msg.md5OfBody(),
+			})
+		}
+		writeSQSResponse(w, map[string]interface{}{"Successful": successful, "Failed": []interface{}{}})
+
+	case "ReceiveMessage":
+		max := req.MaxNumberOfMessages
+		if max == 0 {
+			max = 1
+		}
+		visibility := time.Duration(-1)
+		if req.VisibilityTimeout != nil {
+			visibility = time.Duration(*req.VisibilityTimeout) * time.Second
+		}
+		deadline := time.Now().Add(time.Duration(req.WaitTimeSeconds) * time.Second)
+		msgs := q.Receive(max, visibility)
+		for len(msgs) == 0 && time.Now().Before(deadline) {
+			// invisible messages may become visible without notification
+			q.Wait(r.Context(), time.Second)
+			msgs = q.Receive(max, visibility)
+		}
+		var messages []map[string]interface{}
+		for _, msg := range msgs {
+			messages = append(messages, map[string]interface{}{
+				"MessageId":         msg.ID,
+				"ReceiptHandle":     msg.receiptHandle,
+				"MD5OfBody":         msg.md5OfBody(),
+				"Body":              msg.Body,
+				"Attributes":        msg.attributes(),
+				"MessageAttributes": apiMessageAttributes(msg.MessageAttributes),
+			})
+		}
+		writeSQSResponse(w, map[string]interface{}{"Messages": messages})
+
+	case "DeleteMessage":
+		if !q.Delete(req.ReceiptHandle) {
+			writeSQSError(w, http.StatusBadRequest, "ReceiptHandleIsInvalid", "The input receipt handle is invalid.")
+			return
+		}
+		writeSQSResponse(w, map[string]interface{}{})
+
+	case "DeleteMessageBatch":
+		var successful, failed []map[string]interface{}
+		for _, e := range req.Entries {
+			if q.Delete(e.ReceiptHandle) {
+				successful = append(successful, map[string]interface{}{"Id": e.Id})
+			} else {
+				failed = append(failed, map[string]interface{}{
+					"Id":          e.Id,
+					"Code":        "ReceiptHandleIsInvalid",
+					"SenderFault": true,
+				})
+			}
+		}
+		writeSQSResponse(w, map[string]interface{}{"Successful": successful, "Failed": failed})
+
+	case "ChangeMessageVisibility":
+		timeout := 0
+		if req.VisibilityTimeout != nil {
+			timeout = *req.VisibilityTimeout
+		}
+		if !q.ChangeVisibility(req.ReceiptHandle, time.Duration(timeout)*time.Second) {
+			writeSQSError(w, http.StatusBadRequest, "ReceiptHandleIsInvalid", "The input receipt handle is invalid.")
+			return
+		}
+		writeSQSResponse(w, map[string]interface{}{})
+
+	case "PurgeQueue":
+		q.Purge()
+		writeSQSResponse(w, map[string]interface{}{})
+
+	default:
+		writeSQSError(w, http.StatusBadRequest, "InvalidAction", "Unsupported action: "+action)
+	}
+}
+
+// apiMessageAttributes converts attributes from event shape to api shape,
+// json api uses capitalized field names.
+func apiMessageAttributes(attributes map[string]sqsMessageAttribute) map[string]interface{} {
+	m := make(map[string]interface{})
+	for k, v := range attributes {
+		a := map[string]interface{}{"DataType": v.DataType}
+		if v.StringValue != nil {
+			a["StringValue"] = *v.StringValue
+		}
+		if v.BinaryValue != nil {
+			a["BinaryValue"] = v.BinaryValue
+		}
+		m[k] = a
+	}
+	return m
+}
+
+func writeSQSResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeSQSError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.Header().Set("X-Amzn-Query-Error", code+";Sender")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"__type":  "com.amazonaws.sqs#" + code,
+		"message": message,
+	})
+}
+
+// sqsRecord is a single message in SQS event.
+type sqsRecord struct {
+	MessageID         string                         `json:"messageId"`
+	ReceiptHandle     string                         `json:"receiptHandle"`
+	Body              string                         `json:"body"`
+	Attributes        map[string]string              `json:"attributes"`
+	MessageAttributes map[string]sqsMessageAttribute `json:"messageAttributes"`
+	MD5OfBody         string                         `json:"md5OfBody"`
+	EventSource       string                         `json:"eventSource"`
+	EventSourceARN    string                         `json:"eventSourceARN"`
+	AWSRegion         string                         `json:"awsRegion"`
+}
+
+// sqsPoller implements SQS event source mapping, it polls queue and
+// invokes function with batches of messages. Messages are deleted after
+// successful invocation, failed messages become visible again after
+// visibility timeout.
+type sqsPoller struct {
+	reg     *registry
+	queue   *sqsQueue
+	mapping *EventSourceMapping
+}
+
+func (p *sqsPoller) Serve() error {
+	ctx := context.Background()
+	window := time.Duration(p.mapping.MaximumBatchingWindowInSeconds) * time.Second
+
+	for {
+		batch := p.queue.Receive(p.mapping.BatchSize, -1)
+		if len(batch) == 0 {
+			p.queue.Wait(ctx, time.Second)
+			continue
+		}
+
+		// collect more messages until batch is full or window is closed
+		deadline := time.Now().Add(window)
+		for len(batch) < p.mapping.BatchSize && time.Now().Before(deadline) {
+			p.queue.Wait(ctx, time.Until(deadline))
+			batch = append(batch, p.queue.Receive(p.mapping.BatchSize-len(batch), -1)...)
+		}
+
+		p.invoke(ctx, batch)
+	}
+}
+
+func (p *sqsPoller) invoke(ctx context.Context, batch []*sqsMessage) {
+	var event struct {
+		Records []sqsRecord `json:"Records"`
+	}
+	name := p.mapping.FunctionName
+	if fn, ok := p.reg.Lookup(name); ok {
+		name = fn.Name
+	}
+	var trace string
+	kept := batch[:0]
+	for _, msg := range batch {
+		if msg.TraceHeader == "" {
+			kept = append(kept, msg)
+			continue
+		}
+		// like lambda, messages of recursive loop are dropped
+		if _, err := nextTrace(msg.TraceHeader, name, *maxRecursion); err == errRecursion {
+			log.Println("sqs:", p.queue.Name, p.mapping.FunctionName, "dropping message", msg.ID+":", err)
+			p.queue.Delete(msg.receiptHandle)
+			continue
+		}
+		if trace == "" {
+			trace = msg.TraceHeader
+		}
+		kept = append(kept, msg)
+	}
+	batch = kept
+	if len(batch) == 0 {
+		return
+	}
+	if trace != "" {
+		ctx = subslicer.WithTraceID(ctx, trace)
+	}
+
+	for _, msg := range batch {
+		attributes := msg.MessageAttributes
+		if attributes == nil {
+			attributes = map[string]sqsMessageAttribute{}
+		}
+		event.Records = append(event.Records, sqsRecord{
+			MessageID:         msg.ID,
+			ReceiptHandle:     msg.receiptHandle,
+			Body:              msg.Body,
+			Attributes:        msg.attributes(),
+			MessageAttributes: attributes,
+			MD5OfBody:         msg.md5OfBody(),
+			EventSource:       "aws:sqs",
+			EventSourceARN:    p.queue.arn(),
+			AWSRegion:         *region,
+		})
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Println("sqs:", err)
+		return
+	}
+
+	response, err := p.reg.Invoke(ctx, p.mapping.FunctionName, payload)
+	if err != nil {
+		// whole batch becomes visible again after visibility timeout
+		log.Println("sqs:", p.queue.Name, p.mapping.FunctionName, err)
+		return
+	}
+
+	failed := make(map[string]bool)
+	// empty response reports no failures
+	if p.reportBatchItemFailures() && len(bytes.TrimSpace(response)) > 0 {
+		ids := make(map[string]bool)
+		for _, msg := range batch {
+			ids[msg.ID] = true
+		}
+		var resp struct {
+			BatchItemFailures []struct {
+				ItemIdentifier string `json:"itemIdentifier"`
+			} `json:"batchItemFailures"`
+		}
+		// like lambda, invalid response fails whole batch
+		if err := json.Unmarshal(response, &resp); err != nil {
+			log.Println("sqs:", p.queue.Name, p.mapping.FunctionName, "invalid batch item failures:", err)
+			return
+		}
+		for _, item := range resp.BatchItemFailures {
+			if !ids[item.ItemIdentifier] {
+				log.Println("sqs:", p.queue.Name, p.mapping.FunctionName, "invalid batch item failure:", strconv.Quote(item.ItemIdentifier))
+				return
+			}
+			failed[item.ItemIdentifier] = true
+		}
+	}
+
+	for _, msg := range batch {
+		if !failed[msg.ID] {
+			p.queue.Delete(msg.receiptHandle)
+		}
+	}
+}
+
+func (p *sqsPoller) reportBatchItemFailures() bool {
+	for _, t := range p.mapping.FunctionResponseTypes {
+		if t == "ReportBatchItemFailures" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/bits"
+	"os"
+	"sync"
+	"time"
+)
+
+// streamRecord is a single line of stream source file.
+type streamRecord struct {
+	shard          int
+	sequenceNumber string
+	partitionKey   string
+	arrival        time.Time
+	// data is base64 encoded kinesis data or dynamodb stream record
+	data     string
+	dynamodb map[string]interface{}
+}
+
+// streamSource reads records from local NDJSON file or FIFO, splits them
+// into shards by partition key and invokes function with batches of
+// records in Kinesis or DynamoDB Streams event shape.
+//
+// Records of a shard are further split into ParallelizationFactor lanes,
+// records with the same partition key are always processed in order.
+type streamSource struct {
+	*StreamConfig
+	reg *registry
+
+	lanes    []chan *streamRecord
+	sequence int64
+
+	m          sync.Mutex
+	checkpoint map[string]string
+}
+
+func newStreamSource(reg *registry, config *StreamConfig) (*streamSource, error) {
+	if config.Type != "kinesis" && config.Type != "dynamodb" {
+		return nil, fmt.Errorf("unknown stream type: %s", config.Type)
+	}
+	s := &streamSource{
+		StreamConfig: config,
+		reg:          reg,
+		checkpoint:   make(map[string]string),
+	}
+	data, err := ioutil.ReadFile(config.Checkpoint)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.checkpoint); err != nil {
+			return nil, fmt.Errorf("checkpoint %s: %v", config.Checkpoint, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *streamSource) Serve() error {
+	n := s.Shards * s.ParallelizationFactor
+	s.lanes = make([]chan *streamRecord, n)
+	for i := range s.lanes {
+		s.lanes[i] = make(chan *streamRecord, s.BatchSize)
+		go s.serveLane(i)
+	}
+
+	for {
+		if err := s.read(); err != nil {
+			return err
+		}
+	}
+}
+
+// read reads records until end of file, regular files are followed like
+// with tail -f, FIFOs are reopened for the next writer. Checkpoints are
+// only used for regular files, data written to FIFO is always new.
+func (s *streamSource) read() error {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	regular := info.Mode().IsRegular()
+
+	var line []byte
+	r := bufio.NewReader(f)
+	for {
+		data, err := r.ReadBytes('\n')
+		line = append(line, data...)
+		if err == io.EOF && regular {
+			// wait for more data or the rest of partially written line
+			time.Sleep(time.Second)
+			continue
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+
+		if len(bytesTrimNewline(line)) > 0 {
+			s.sequence++
+			record, perr := s.parse(s.sequence, line)
+			if perr != nil {
+				log.Println("stream:", s.Path, s.sequence, perr)
+			} else if lane := s.lane(record); !regular || !s.done(lane, record.sequenceNumber) {
+				s.lanes[lane] <- record
+			}
+		}
+		line = nil
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func (s *streamSource) parse(line int64, data []byte) (*streamRecord, error) {
+	// sequence numbers are line numbers padded to compare as strings
+	record := &streamRecord{
+		sequenceNumber: fmt.Sprintf("%021d", line),
+		arrival:        time.Now(),
+	}
+
+	switch s.Type {
+	case "kinesis":
+		// get-records dump has PartitionKey and base64 encoded Data,
+		// otherwise the whole line is record data, json object or not
+		if key, value, ok := kinesisDump(data); ok {
+			record.partitionKey = key
+			record.data = value
+		} else {
+			record.data = base64.StdEncoding.EncodeToString(bytesTrimNewline(data))
+		}
+		if record.partitionKey == "" {
+			record.partitionKey = record.sequenceNumber
+		}
+
+	case "dynamodb":
+		record.dynamodb = make(map[string]interface{})
+		if err := json.Unmarshal(data, &record.dynamodb); err != nil {
+			return nil, err
+		}
+		ddb, _ := record.dynamodb["dynamodb"].(map[string]interface{})
+		if ddb == nil {
+			return nil, fmt.Errorf("missing dynamodb field")
+		}
+		// items are partitioned by primary key
+		keys, _ := json.Marshal(ddb["Keys"])
+		record.partitionKey = string(keys)
+	}
+
+	sum := md5.Sum([]byte(record.partitionKey))
+	hash := binary.BigEndian.Uint64(sum[:8])
+	// hash key range is split evenly, high word of product is the shard
+	shard, _ := bits.Mul64(hash, uint64(s.Shards))
+	record.shard = int(shard)
+	return record, nil
+}
+
+// kinesisDump returns partition key and data of get-records dump record.
+// Keys are matched exactly, records of user with data or partitionKey
+// fields are not dumps.
+func kinesisDump(line []byte) (key, data string, ok bool) {
+	var v map[string]json.RawMessage
+	if err := json.Unmarshal(line, &v); err != nil {
+		return "", "", false
+	}
+	if json.Unmarshal(v["PartitionKey"], &key) != nil || json.Unmarshal(v["Data"], &data) != nil {
+		return "", "", false
+	}
+	if _, err := base64.StdEncoding.DecodeString(data); err != nil {
+		return "", "", false
+	}
+	return key, data, true
+}
+
+// lane returns index of ordered lane of shard for record.
+func (s *streamSource) lane(record *streamRecord) int {
+	sum := md5.Sum([]byte(record.partitionKey))
+	return record.shard*s.ParallelizationFactor + int(sum[15])%s.ParallelizationFactor
+}
+
+func (s *streamSource) serveLane(lane int) {
+	ctx := context.Background()
+	for record := range s.lanes[lane] {
+		batch := []*streamRecord{record}
+		// take whatever is already read, up to batch size
+	collect:
+		for len(batch) < s.BatchSize {
+			select {
+			case record := <-s.lanes[lane]:
+				batch = append(batch, record)
+			default:
+				break collect
+			}
+		}
+
+		s.process(ctx, batch)
+		s.commit(lane, batch[len(batch)-1].sequenceNumber)
+	}
+}
+
+// process invokes function with batch, failed batches are retried or
+// split in half when BisectBatchOnFunctionError is set.
+func (s *streamSource) process(ctx context.Context, batch []*streamRecord) {
+	for attempt := 0; ; attempt++ {
+		err := s.invoke(ctx, batch)
+		if err == nil {
+			return
+		}
+		log.Println("stream:", s.StreamName, s.FunctionName, err)
+
+		if err == errThrottled || err == errReservedThrottled {
+			// throttled batches are retried without counting attempts
+			attempt--
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if err == errFunctionError && s.BisectBatchOnFunctionError && len(batch) > 1 {
+			mid := len(batch) / 2
+			s.process(ctx, batch[:mid])
+			s.process(ctx, batch[mid:])
+			return
+		}
+
+		if max := *s.MaximumRetryAttempts; max >= 0 && attempt >= max {
+			log.Println("stream: discarding", len(batch), "records",
+				batch[0].sequenceNumber, "-", batch[len(batch)-1].sequenceNumber)
+			return
+		}
+
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+}
+
+func (s *streamSource) invoke(ctx context.Context, batch []*streamRecord) error {
+	var event struct {
+		Records []interface{} `json:"Records"`
+	}
+	for _, record := range batch {
+		event.Records = append(event.Records, s.event(record))
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = s.reg.Invoke(ctx, s.FunctionName, payload)
+	return err
+}
+
+func (s *streamSource) event(record *streamRecord) interface{} {
+	shardID := fmt.Sprintf("shardId-%012d", record.shard)
+
+	if s.Type == "dynamodb" {
+		event := make(map[string]interface{})
+		for k, v := range record.dynamodb {
+			event[k] = v
+		}
+		setDefault(event, "eventID", record.sequenceNumber)
+		setDefault(event, "eventVersion", "1.1")
+		setDefault(event, "eventSource", "aws:dynamodb")
+		setDefault(event, "awsRegion", *region)
+		event["eventSourceARN"] = fmt.Sprintf("arn:aws:dynamodb:%s:%s:table/%s/stream/2020-01-01T00:00:00.000",
+			*region, accountID, s.StreamName)
+		ddb := event["dynamodb"].(map[string]interface{})
+		setDefault(ddb, "SequenceNumber", record.sequenceNumber)
+		setDefault(ddb, "ApproximateCreationDateTime", record.arrival.Unix())
+		return event
+	}
+
+	return map[string]interface{}{
+		"kinesis": map[string]interface{}{
+			"kinesisSchemaVersion":        "1.0",
+			"partitionKey":                record.partitionKey,
+			"sequenceNumber":              record.sequenceNumber,
+			"data":                        record.data,
+			"approximateArrivalTimestamp": float64(record.arrival.UnixNano()) / 1e9,
+		},
+		"eventSource":       "aws:kinesis",
+		"eventVersion":      "1.0",
+		"eventID":           shardID + ":" + record.sequenceNumber,
+		"eventName":         "aws:kinesis:record",
+		"invokeIdentityArn": fmt.Sprintf("arn:aws:iam::%s:role/lambda-role", accountID),
+		"awsRegion":         *region,
+		"eventSourceARN":    fmt.Sprintf("arn:aws:kinesis:%s:%s:stream/%s", *region, accountID, s.StreamName),
+	}
+}
+
+// done reports whether record was processed before restart.
+func (s *streamSource) done(lane int, sequenceNumber string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return sequenceNumber <= s.checkpoint[s.laneID(lane)]
+}
+
+// commit stores last processed sequence number of lane in checkpoint
+// file.
+func (s *streamSource) commit(lane int, sequenceNumber string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.checkpoint[s.laneID(lane)] = sequenceNumber
+
+	data, err := json.MarshalIndent(s.checkpoint, "", "  ")
+	if err != nil {
+		log.Println("stream:", err)
+		return
+	}
+	tmp := s.Checkpoint + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Println("stream:", err)
+		return
+	}
+	if err := os.Rename(tmp, s.Checkpoint); err != nil {
+		log.Println("stream:", err)
+	}
+}
+
+func (s *streamSource) laneID(lane int) string {
+	return fmt.Sprintf("shardId-%012d/%d", lane/s.ParallelizationFactor, lane%s.ParallelizationFactor)
+}
+
+func setDefault(m map[string]interface{}, key string, value interface{}) {
+	if _, ok := m[key]; !ok {
+		m[key] = value
+	}
+}
+
+func bytesTrimNewline(data []byte) []byte {
+	for len(data) > 0 && (data[len(data)-1] == '\n' || data[len(data)-1] == '\r') {
+		data = data[:len(data)-1]
+	}
+	return data
+}
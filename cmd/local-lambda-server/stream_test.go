@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestStreamParseKinesis(t *testing.T) {
+	raw := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		line string
+		key  string
+		data string
+	}{
+		{`{"PartitionKey": "k1", "Data": "aGVsbG8="}`, "k1", "aGVsbG8="},
+		{`{"SequenceNumber": "1", "PartitionKey": "k1", "Data": "aGVsbG8="}`, "k1", "aGVsbG8="},
+		{`{"data": "aGVsbG8=", "partitionKey": "k1"}`, "", raw(`{"data": "aGVsbG8=", "partitionKey": "k1"}`)},
+		{`{"Data": "aGVsbG8="}`, "", raw(`{"Data": "aGVsbG8="}`)},
+		{`{"PartitionKey": "k1", "Data": "not base64!"}`, "", raw(`{"PartitionKey": "k1", "Data": "not base64!"}`)},
+		{`{"PartitionKey": "k1", "Data": {"id": 1}}`, "", raw(`{"PartitionKey": "k1", "Data": {"id": 1}}`)},
+		{`{"id": 1}`, "", raw(`{"id": 1}`)},
+		{"plain text\n", "", raw("plain text")},
+	}
+	s := &streamSource{StreamConfig: &StreamConfig{Type: "kinesis", Shards: 1}}
+	for _, tt := range tests {
+		r, err := s.parse(7, []byte(tt.line))
+		if err != nil {
+			t.Errorf("parse(%s): %v", tt.line, err)
+			continue
+		}
+		key := tt.key
+		if key == "" {
+			key = r.sequenceNumber
+		}
+		if r.partitionKey != key || r.data != tt.data {
+			t.Errorf("parse(%s) = %q, %q, want %q, %q", tt.line, r.partitionKey, r.data, key, tt.data)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dzeromsk/subslicer"
+)
+
+// errRecursion stops invocation of function that appears in call chain
+// more than -max-recursion times.
+var errRecursion = errors.New("recursive invocation loop detected")
+
+// traceContext returns context with trace header of invocation of fn.
+// Trace root of caller is kept, Lineage counts invocations of each
+// function in call chain, like lambda recursive loop detection.
+func traceContext(ctx context.Context, fn *function) (context.Context, error) {
+	header, err := nextTrace(subslicer.TraceID(ctx), fn.Name, *maxRecursion)
+	if err != nil {
+		return nil, err
+	}
+	return subslicer.WithTraceID(ctx, header), nil
+}
+
+// nextTrace returns trace header of invocation of function called with
+// header, empty header starts new trace.
+func nextTrace(header, name string, max int) (string, error) {
+	var keys []string
+	fields := make(map[string]string)
+	for _, part := range strings.Split(header, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		if _, ok := fields[kv[0]]; !ok {
+			keys = append(keys, kv[0])
+		}
+		fields[kv[0]] = kv[1]
+	}
+	set := func(k, v string) {
+		if _, ok := fields[k]; !ok {
+			keys = append(keys, k)
+		}
+		fields[k] = v
+	}
+
+	if fields["Root"] == "" {
+		set("Root", fmt.Sprintf("1-%08x-%s", time.Now().Unix(), randomHex(12)))
+	}
+	set("Parent", randomHex(8))
+	if fields["Sampled"] == "" {
+		set("Sampled", "0")
+	}
+
+	hash := lineageHash(name)
+	var lineage []string
+	count := 0
+	if v := fields["Lineage"]; v != "" {
+		for _, entry := range strings.Split(v, "|") {
+			i := strings.IndexByte(entry, ':')
+			if i < 0 {
+				continue
+			}
+			if entry[:i] == hash {
+				count, _ = strconv.Atoi(entry[i+1:])
+				continue
+			}
+			lineage = append(lineage, entry)
+		}
+	}
+	count++
+	if count > max {
+		return "", errRecursion
+	}
+	set("Lineage", strings.Join(append(lineage, hash+":"+strconv.Itoa(count)), "|"))
+
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, k+"="+fields[k])
+	}
+	return strings.Join(parts, ";"), nil
+}
+
+// lineageHash identifies function in Lineage field.
+func lineageHash(name string) string {
+	sum := sha256.Sum256([]byte(functionArn(name)))
+	return hex.EncodeToString(sum[:4])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func traceFields(header string) map[string]string {
+	fields := make(map[string]string)
+	for _, part := range strings.Split(header, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	return fields
+}
+
+func TestNextTrace(t *testing.T) {
+	a, b := lineageHash("a"), lineageHash("b")
+	root := "1-5759e988-bd862e3fe1be46a994272793"
+	tests := []struct {
+		header  string
+		name    string
+		max     int
+		root    string
+		sampled string
+		lineage string
+		err     error
+	}{
+		{"", "a", 16, "", "0", a + ":1", nil},
+		{"Root=" + root, "a", 16, root, "0", a + ":1", nil},
+		{"Root=" + root + ";Sampled=1", "a", 16, root, "1", a + ":1", nil},
+		{"Root=" + root + ";Lineage=" + a + ":1", "a", 16, root, "0", a + ":2", nil},
+		{"Root=" + root + ";Lineage=" + a + ":3", "b", 16, root, "0", a + ":3|" + b + ":1", nil},
+		{"Root=" + root + ";Lineage=" + a + ":2|" + b + ":1", "a", 16, root, "0", b + ":1|" + a + ":3", nil},
+		{"Root=" + root + ";Lineage=bogus|" + a + ":1", "a", 16, root, "0", a + ":2", nil},
+		{"Root=" + root + ";Lineage=" + a + ":15", "a", 16, root, "0", a + ":16", nil},
+		{"Root=" + root + ";Lineage=" + a + ":16", "a", 16, "", "", "", errRecursion},
+		{"Root=" + root + ";Lineage=" + a + ":16", "b", 16, root, "0", a + ":16|" + b + ":1", nil},
+		{"", "a", 0, "", "", "", errRecursion},
+	}
+	rootRE := regexp.MustCompile(`^1-[0-9a-f]{8}-[0-9a-f]{24}$`)
+	for _, tt := range tests {
+		header, err := nextTrace(tt.header, tt.name, tt.max)
+		if err != tt.err {
+			t.Errorf("nextTrace(%q, %q): err = %v, want %v", tt.header, tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		fields := traceFields(header)
+		if tt.root == "" {
+			if !rootRE.MatchString(fields["Root"]) {
+				t.Errorf("nextTrace(%q): bad new Root %q", tt.header, fields["Root"])
+			}
+		} else if fields["Root"] != tt.root {
+			t.Errorf("nextTrace(%q): Root = %q, want %q", tt.header, fields["Root"], tt.root)
+		}
+		if len(fields["Parent"]) != 16 {
+			t.Errorf("nextTrace(%q): bad Parent %q", tt.header, fields["Parent"])
+		}
+		if fields["Sampled"] != tt.sampled {
+			t.Errorf("nextTrace(%q): Sampled = %q, want %q", tt.header, fields["Sampled"], tt.sampled)
+		}
+		if fields["Lineage"] != tt.lineage {
+			t.Errorf("nextTrace(%q, %q): Lineage = %q, want %q", tt.header, tt.name, fields["Lineage"], tt.lineage)
+		}
+	}
+}
+
+func TestNextTraceKeepsFields(t *testing.T) {
+	header, err := nextTrace("Root=1-5759e988-bd862e3fe1be46a994272793;Self=x;Parent=53995c3f42cd8ad8", "a", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(header, "Root=1-5759e988-bd862e3fe1be46a994272793;Self=x;Parent=") {
+		t.Errorf("field order not kept: %s", header)
+	}
+	if strings.Contains(header, "Parent=53995c3f42cd8ad8") {
+		t.Errorf("Parent not replaced: %s", header)
+	}
+}
+
+func TestLineageHash(t *testing.T) {
+	if lineageHash("a") != lineageHash("a") {
+		t.Error("lineageHash not stable")
+	}
+	if lineageHash("a") == lineageHash("b") {
+		t.Error("lineageHash collision")
+	}
+	if h := lineageHash("a"); len(h) != 8 {
+		t.Errorf("lineageHash = %q, want 8 hex chars", h)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// defaultIgnore skips editor temporary files, bytecode and vcs metadata.
+var defaultIgnore = []string{
+	".git/",
+	".hg/",
+	".svn/",
+	"__pycache__/",
+	"node_modules/.cache/",
+	"*.pyc",
+	"*.pyo",
+	"*.swp",
+	"*.swx",
+	"*~",
+	".#*",
+	"#*#",
+	"4913",
+	".DS_Store",
+}
+
+// ignoreRule is a single .gitignore style pattern.
+type ignoreRule struct {
+	pattern  []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ignoreRules matches paths relative to task dir, later rules take
+// precedence like in .gitignore.
+type ignoreRules []ignoreRule
+
+func parseIgnore(lines []string) ignoreRules {
+	var rules ignoreRules
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r ignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, "\\")
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		// patterns with slash are relative to task dir, others match
+		// at any depth
+		if strings.Contains(line, "/") {
+			r.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		r.pattern = strings.Split(line, "/")
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// readIgnoreFile returns lines of .gitignore file, missing file is empty.
+func readIgnoreFile(name string) []string {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	return lines
+}
+
+// taskIgnore returns ignore rules of task dir, defaults, .gitignore file
+// and patterns from config.
+func taskIgnore(fc *FunctionConfig) ignoreRules {
+	lines := append([]string(nil), defaultIgnore...)
+	lines = append(lines, readIgnoreFile(filepath.Join(fc.Task, ".gitignore"))...)
+	lines = append(lines, fc.Watch.Ignore...)
+	return parseIgnore(lines)
+}
+
+// Match reports whether path, or any of its parent dirs, is ignored.
+func (rules ignoreRules) Match(rel string, dir bool) bool {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := 1; i <= len(parts); i++ {
+		if rules.match(parts[:i], dir || i < len(parts)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rules ignoreRules) match(parts []string, dir bool) bool {
+	ignored := false
+	for _, r := range rules {
+		if r.dirOnly && !dir {
+			continue
+		}
+		var ok bool
+		if r.anchored {
+			ok = matchSegments(r.pattern, parts)
+		} else {
+			ok = matchSegments(r.pattern, parts[len(parts)-1:])
+		}
+		if ok {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// matchSegments matches path segments, ** matches any number of them.
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(pattern[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// watchedTask is task dir of function with its ignore rules and pending
+// reload.
+type watchedTask struct {
+	fn     *function
+	ignore ignoreRules
+	delay  time.Duration
+
+	m     sync.Mutex
+	timer *time.Timer
+
+	// changes made by build command do not trigger another reload.
+	// Paths changed while building, that previous build did not change
+	// as well, may be edits made meanwhile and trigger another build.
+	building             bool
+	buildStart, buildEnd time.Time
+	changed, outputs     map[string]bool
+}
+
+// taskWatcher watches task dirs of functions recursively, or deployment
+// packages, and reloads functions after their files change.
+type taskWatcher struct {
+	reg     *registry
+	watcher *fsnotify.Watcher
+	tasks   []*watchedTask
+}
+
+func newTaskWatcher(reg *registry) (*taskWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &taskWatcher{reg: reg, watcher: watcher}
+
+	for _, fn := range reg.Functions() {
+		t := &watchedTask{
+			fn:     fn,
+			ignore: taskIgnore(fn.FunctionConfig),
+			delay:  time.Duration(fn.Watch.DebounceInMilliseconds) * time.Millisecond,
+		}
+		w.tasks = append(w.tasks, t)
+		if fn.Zip != "" {
+			// only deployment package is served
+			if err := watcher.Add(filepath.Dir(fn.Zip)); err != nil {
+				watcher.Close()
+				return nil, err
+			}
+			continue
+		}
+		if err := w.add(t, fn.Task); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// add watches dir and its subdirectories not ignored by task.
+func (w *taskWatcher) add(t *watchedTask, dir string) error {
+	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name != dir {
+				// removed while walking
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if rel, _ := filepath.Rel(t.fn.Task, name); rel != "." && t.ignore.Match(rel, true) {
+			return filepath.SkipDir
+		}
+		return w.watcher.Add(name)
+	})
+}
+
+func (w *taskWatcher) Serve() error {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return nil
+			}
+			w.handle(event)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Println("error:", err)
+			return err
+		}
+	}
+}
+
+func (w *taskWatcher) handle(event fsnotify.Event) {
+	if event.Op == fsnotify.Chmod {
+		return
+	}
+
+	for _, t := range w.tasks {
+		if t.fn.Zip != "" {
+			if filepath.Clean(event.Name) != filepath.Clean(t.fn.Zip) {
+				continue
+			}
+			if info, err := os.Stat(event.Name); err == nil && !t.built(event.Name, info) {
+				t.reload(w.reg)
+			}
+			continue
+		}
+
+		rel, err := filepath.Rel(t.fn.Task, event.Name)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+
+		info, err := os.Stat(event.Name)
+		dir := err == nil && info.IsDir()
+		if t.ignore.Match(rel, dir) {
+			continue
+		}
+		if dir && event.Op&fsnotify.Create != 0 {
+			// removed dirs are dropped by fsnotify
+			if err := w.add(t, event.Name); err != nil {
+				log.Println("watch:", err)
+			}
+		}
+		if t.built(event.Name, info) {
+			continue
+		}
+		if *debug {
+			log.Println("watch:", t.fn.Name, event)
+		}
+		t.reload(w.reg)
+	}
+}
+
+// reload reloads function once no change is seen for debounce delay.
+func (t *watchedTask) reload(reg *registry) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.timer != nil {
+		t.timer.Reset(t.delay)
+		return
+	}
+	t.timer = time.AfterFunc(t.delay, func() {
+		t.m.Lock()
+		t.timer = nil
+		t.m.Unlock()
+
+		if t.fn.Build != "" {
+			ok, again := t.build()
+			if again {
+				log.Println("Changed while building:", t.fn.Name)
+				defer t.reload(reg)
+			}
+			if !ok {
+				log.Println("Reload skipped, serving generation", t.fn.pool.Generation(), "of", t.fn.Name)
+				return
+			}
+		}
+
+		log.Println("Reload:", t.fn.Name)
+		reg.Reload(t.fn)
+	})
+}
+
+// build runs build command of function, it reports whether build
+// succeeded and whether paths not changed by previous build were changed
+// while building.
+func (t *watchedTask) build() (ok, again bool) {
+	t.m.Lock()
+	t.building = true
+	// file times come from coarse kernel clock and may be a tick behind
+	t.buildStart = time.Now().Add(-10 * time.Millisecond)
+	t.changed = make(map[string]bool)
+	t.m.Unlock()
+
+	err := build(t.fn)
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.building = false
+	t.buildEnd = time.Now()
+	// events may be handled after build is done, like ones of startup
+	// build, outputs are files modified while building
+	t.scan()
+	for name := range t.changed {
+		if !t.outputs[name] {
+			again = true
+		}
+	}
+	t.outputs = t.changed
+	return err == nil, again
+}
+
+// scan adds files of task modified while building to changed files.
+func (t *watchedTask) scan() {
+	inWindow := func(info os.FileInfo) bool {
+		mtime := info.ModTime()
+		return !mtime.Before(t.buildStart) && !mtime.After(t.buildEnd)
+	}
+	if t.fn.Zip != "" {
+		if info, err := os.Stat(t.fn.Zip); err == nil && inWindow(info) {
+			t.changed[filepath.Clean(t.fn.Zip)] = true
+		}
+		return
+	}
+	filepath.Walk(t.fn.Task, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if rel, _ := filepath.Rel(t.fn.Task, name); rel != "." && t.ignore.Match(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if inWindow(info) {
+			t.changed[name] = true
+		}
+		return nil
+	})
+}
+
+// Build runs build commands of functions before first instances start,
+// failed build serves whatever is in task dir.
+func (w *taskWatcher) Build() {
+	for _, t := range w.tasks {
+		if t.fn.Build != "" {
+			t.build()
+		}
+	}
+}
+
+// built reports whether change of file was made while building and is
+// output of build command, changes seen while building are decided once
+// build is done.
+func (t *watchedTask) built(name string, info os.FileInfo) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.building {
+		t.changed[name] = true
+		return true
+	}
+	if info == nil {
+		return false
+	}
+	// late event of change made while building
+	mtime := info.ModTime()
+	if !mtime.Before(t.buildStart) && !mtime.After(t.buildEnd) {
+		return t.outputs[name]
+	}
+	return false
+}
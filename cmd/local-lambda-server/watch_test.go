@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreMatch(t *testing.T) {
+	tests := []struct {
+		rules string
+		path  string
+		dir   bool
+		want  bool
+	}{
+		{"*.pyc", "app.pyc", false, true},
+		{"*.pyc", "pkg/mod/app.pyc", false, true},
+		{"*.pyc", "app.py", false, false},
+		{"# comment", "# comment", false, false},
+		{"\\#file", "#file", false, true},
+		{"*.log\n!keep.log", "debug.log", false, true},
+		{"*.log\n!keep.log", "keep.log", false, false},
+		{"!keep.log\n*.log", "keep.log", false, true},
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "build/out.js", false, true},
+		{"build/", "src/build/out.js", false, true},
+		{"logs/\n!logs/keep.log", "logs/keep.log", false, true},
+		{"/dist", "dist", true, true},
+		{"/dist", "src/dist", true, false},
+		{"src/*.gen.go", "src/a.gen.go", false, true},
+		{"src/*.gen.go", "lib/src/a.gen.go", false, false},
+		{"src/*.gen.go", "src/sub/a.gen.go", false, false},
+		{"**/fixtures", "fixtures", true, true},
+		{"**/fixtures", "a/b/fixtures/data.json", false, true},
+		{"docs/**/*.md", "docs/README.md", false, true},
+		{"docs/**/*.md", "docs/a/b/c.md", false, true},
+		{"docs/**/*.md", "src/docs/c.md", false, false},
+		{"vendor/**", "vendor/x/y.go", false, true},
+		{"vendor/**", "vendored.go", false, false},
+		{"", "anything", false, false},
+	}
+	for _, tt := range tests {
+		rules := parseIgnore(strings.Split(tt.rules, "\n"))
+		if got := rules.Match(tt.path, tt.dir); got != tt.want {
+			t.Errorf("%q: Match(%q, %v) = %v, want %v", tt.rules, tt.path, tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultIgnore(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{".git/HEAD", true},
+		{"pkg/__pycache__/mod.cpython-39.pyc", true},
+		{"handler.py.swp", true},
+		{".#handler.py", true},
+		{"handler.py~", true},
+		{"4913", true},
+		{"node_modules/.cache/x", true},
+		{"node_modules/lib/index.js", false},
+		{"handler.py", false},
+	}
+	rules := parseIgnore(defaultIgnore)
+	for _, tt := range tests {
+		if got := rules.Match(tt.path, false); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestBuildOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := &function{FunctionConfig: &FunctionConfig{Name: "local", Task: dir}}
+	task := &watchedTask{fn: fn, ignore: parseIgnore(defaultIgnore)}
+	tests := []struct {
+		build string
+		again bool
+	}{
+		// startup build, outputs are not known yet
+		{"echo a > out.js", true},
+		{"echo b > out.js", false},
+		{"echo c > out.js; echo c > new.js", true},
+		{"echo d > out.js; echo d > new.js", false},
+		{"echo e > out.js", false},
+	}
+	for _, tt := range tests {
+		fn.Build = tt.build
+		ok, again := task.build()
+		if !ok || again != tt.again {
+			t.Errorf("%s: build = %v, %v, want true, %v", tt.build, ok, again, tt.again)
+		}
+		// late event of build output
+		name := filepath.Join(dir, "out.js")
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !task.built(name, info) {
+			t.Errorf("%s: late event of output not skipped", tt.build)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const wsAPIID = "localwsapi"
+
+// wsRequest is the event passed to functions integrated with WebSocket API
+// routes.
+type wsRequest struct {
+	RequestContext                  wsRequestContext    `json:"requestContext"`
+	Headers                         map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders               map[string][]string `json:"multiValueHeaders,omitempty"`
+	QueryStringParameters           map[string]string   `json:"queryStringParameters,omitempty"`
+	MultiValueQueryStringParameters map[string][]string `json:"multiValueQueryStringParameters,omitempty"`
+	Body                            string              `json:"body,omitempty"`
+	IsBase64Encoded                 bool                `json:"isBase64Encoded"`
+}
+
+type wsRequestContext struct {
+	RouteKey             string     `json:"routeKey"`
+	MessageID            string     `json:"messageId,omitempty"`
+	EventType            string     `json:"eventType"`
+	ExtendedRequestID    string     `json:"extendedRequestId"`
+	RequestTime          string     `json:"requestTime"`
+	MessageDirection     string     `json:"messageDirection"`
+	DisconnectStatusCode int        `json:"disconnectStatusCode,omitempty"`
+	DisconnectReason     string     `json:"disconnectReason,omitempty"`
+	Stage                string     `json:"stage"`
+	ConnectedAt          int64      `json:"connectedAt"`
+	RequestTimeEpoch     int64      `json:"requestTimeEpoch"`
+	Identity             wsIdentity `json:"identity"`
+	RequestID            string     `json:"requestId"`
+	DomainName           string     `json:"domainName"`
+	ConnectionID         string     `json:"connectionId"`
+	APIID                string     `json:"apiId"`
+}
+
+type wsIdentity struct {
+	SourceIP  string `json:"sourceIp"`
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+// wsResponse is the optional response of route integration, body is sent
+// back to the client.
+type wsResponse struct {
+	StatusCode int    `json:"statusCode"`
+	Body       string `json:"body"`
+}
+
+type wsConn struct {
+	*websocket.Conn
+
+	id          string
+	domainName  string
+	identity    wsIdentity
+	connectedAt time.Time
+
+	m            sync.Mutex
+	lastActiveAt time.Time
+}
+
+func (c *wsConn) send(data []byte) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.lastActiveAt = time.Now()
+	return c.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *wsConn) touch() {
+	c.m.Lock()
+	c.lastActiveAt = time.Now()
+	c.m.Unlock()
+}
+
+// wsServer emulates API Gateway WebSocket API and its @connections
+// management API.
+type wsServer struct {
+	reg      *registry
+	config   *WebSocketConfig
+	upgrader websocket.Upgrader
+
+	m     sync.Mutex
+	conns map[string]*wsConn
+}
+
+func newWebSocketServer(reg *registry, config *WebSocketConfig) *wsServer {
+	return &wsServer{
+		reg:    reg,
+		config: config,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		conns: make(map[string]*wsConn),
+	}
+}
+
+func (s *wsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// management api is available as /@connections/{id} and, to match
+	// callback url built by handlers, as /{stage}/@connections/{id}
+	path := strings.TrimPrefix(r.URL.Path, "/"+s.config.Stage)
+	if strings.HasPrefix(path, "/@connections/") {
+		s.serveConnections(w, r, strings.TrimPrefix(path, "/@connections/"))
+		return
+	}
+	s.serveWebSocket(w, r)
+}
+
+func (s *wsServer) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	c := &wsConn{
+		id:          wsID(),
+		domainName:  r.Host,
+		connectedAt: time.Now(),
+		identity: wsIdentity{
+			SourceIP:  host,
+			UserAgent: r.UserAgent(),
+		},
+	}
+	c.lastActiveAt = c.connectedAt
+
+	// $connect may reject connection before upgrade
+	event := s.newRequest(c, "$connect", "CONNECT")
+	event.Headers = make(map[string]string)
+	event.MultiValueHeaders = make(map[string][]string)
+	for k, v := range r.Header {
+		event.Headers[k] = v[len(v)-1]
+		event.MultiValueHeaders[k] = v
+	}
+	if query := r.URL.Query(); len(query) > 0 {
+		event.QueryStringParameters = make(map[string]string)
+		event.MultiValueQueryStringParameters = query
+		for k, v := range query {
+			event.QueryStringParameters[k] = v[len(v)-1]
+		}
+	}
+	if fn, ok := s.config.Routes["$connect"]; ok {
+		resp, err := s.invoke(fn, event)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Println("websocket:", err)
+			return
+		}
+		if resp.StatusCode != 0 && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+			http.Error(w, http.StatusText(resp.StatusCode), resp.StatusCode)
+			return
+		}
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("websocket:", err)
+		return
+	}
+	c.Conn = conn
+
+	s.m.Lock()
+	s.conns[c.id] = c
+	s.m.Unlock()
+
+	log.Println("websocket: connected", c.id)
+
+	// messages of connection are handled in order, reading continues
+	// meanwhile so control frames are answered
+	type frame struct {
+		kind int
+		data []byte
+	}
+	frames := make(chan frame, 64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for f := range frames {
+			s.message(c, f.kind, f.data)
+		}
+	}()
+
+	status, reason := websocket.CloseNormalClosure, ""
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			if e, ok := err.(*websocket.CloseError); ok {
+				status, reason = e.Code, e.Text
+			} else {
+				status, reason = websocket.CloseAbnormalClosure, err.Error()
+			}
+			break
+		}
+		c.touch()
+		frames <- frame{kind, data}
+	}
+	close(frames)
+	<-done
+
+	s.disconnect(c, status, reason)
+}
+
+func (s *wsServer) message(c *wsConn, kind int, data []byte) {
+	// binary frames are passed base64 encoded and can't select route
+	binary := kind == websocket.BinaryMessage
+	routeKey := "$default"
+	if !binary {
+		routeKey = s.routeKey(data)
+	}
+	fn, ok := s.config.Routes[routeKey]
+	if !ok {
+		routeKey = "$default"
+		fn, ok = s.config.Routes[routeKey]
+	}
+	if !ok {
+		c.send([]byte(`{"message": "Forbidden", "connectionId":"` + c.id + `"}`))
+		return
+	}
+
+	event := s.newRequest(c, routeKey, "MESSAGE")
+	event.RequestContext.MessageID = wsID()
+	event.Body = string(data)
+	if binary {
+		event.Body = base64.StdEncoding.EncodeToString(data)
+		event.IsBase64Encoded = true
+	}
+
+	resp, err := s.invoke(fn, event)
+	if err != nil {
+		c.send([]byte(`{"message": "Internal server error", "connectionId":"` + c.id + `"}`))
+		log.Println("websocket:", err)
+		return
+	}
+	if resp.Body != "" {
+		c.send([]byte(resp.Body))
+	}
+}
+
+func (s *wsServer) disconnect(c *wsConn, status int, reason string) {
+	s.m.Lock()
+	delete(s.conns, c.id)
+	s.m.Unlock()
+
+	c.Close()
+	log.Println("websocket: disconnected", c.id, status, reason)
+
+	fn, ok := s.config.Routes["$disconnect"]
+	if !ok {
+		return
+	}
+	event := s.newRequest(c, "$disconnect", "DISCONNECT")
+	event.RequestContext.DisconnectStatusCode = status
+	event.RequestContext.DisconnectReason = reason
+	if _, err := s.invoke(fn, event); err != nil {
+		log.Println("websocket:", err)
+	}
+}
+
+// routeKey evaluates route selection expression against message body,
+// only $request.body.<path> expressions are supported.
+func (s *wsServer) routeKey(data []byte) string {
+	const prefix = "$request.body."
+	expr := s.config.RouteSelectionExpression
+	if !strings.HasPrefix(expr, prefix) {
+		return "$default"
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return "$default"
+	}
+	for _, key := range strings.Split(strings.TrimPrefix(expr, prefix), ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "$default"
+		}
+		v = m[key]
+	}
+	if key, ok := v.(string); ok {
+		return key
+	}
+	return "$default"
+}
+
+func (s *wsServer) newRequest(c *wsConn, routeKey, eventType string) *wsRequest {
+	now := time.Now().UTC()
+	return &wsRequest{
+		RequestContext: wsRequestContext{
+			RouteKey:          routeKey,
+			EventType:         eventType,
+			ExtendedRequestID: wsID(),
+			RequestTime:       now.Format("02/Jan/2006:15:04:05 -0700"),
+			MessageDirection:  "IN",
+			Stage:             s.config.Stage,
+			ConnectedAt:       c.connectedAt.UnixNano() / 1e6,
+			RequestTimeEpoch:  now.UnixNano() / 1e6,
+			Identity:          c.identity,
+			RequestID:         wsID(),
+			DomainName:        c.domainName,
+			ConnectionID:      c.id,
+			APIID:             wsAPIID,
+		},
+	}
+}
+
+func (s *wsServer) invoke(fn string, event *wsRequest) (*wsResponse, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.reg.Invoke(context.Background(), fn, payload)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(wsResponse)
+	// handlers are not required to return anything
+	json.Unmarshal(data, resp)
+	return resp, nil
+}
+
+func (s *wsServer) serveConnections(w http.ResponseWriter, r *http.Request, id string) {
+	s.m.Lock()
+	c, ok := s.conns[id]
+	s.m.Unlock()
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte(`{"message":null}`))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.send(data); err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+	case http.MethodGet:
+		c.m.Lock()
+		info := struct {
+			ConnectedAt  string     `json:"connectedAt"`
+			Identity     wsIdentity `json:"identity"`
+			LastActiveAt string     `json:"lastActiveAt"`
+		}{
+			ConnectedAt:  c.connectedAt.UTC().Format(time.RFC3339),
+			Identity:     c.identity,
+			LastActiveAt: c.lastActiveAt.UTC().Format(time.RFC3339),
+		}
+		c.m.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	case http.MethodDelete:
+		// read loop notices closed connection and runs $disconnect
+		c.m.Lock()
+		c.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Going away"),
+			time.Now().Add(time.Second))
+		c.m.Unlock()
+		c.Close()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// wsID returns random id in API Gateway connection and request id format,
+// url safe alphabet is used as ids are part of @connections urls.
+func wsID() string {
+	var b [10]byte
+	rand.Read(b[:])
+	return base64.URLEncoding.EncodeToString(b[:])
+}
@@ -20,6 +20,13 @@ var (
 	errHandlerBusy    = errors.New("handler is busy")
 	errInvalidMagic   = errors.New("invalid magic")
 	errKVParserFailed = errors.New("kv parser failed")
+
+	// ErrHandlerError is returned by Invoke when handler reports an error,
+	// handler can't be invoked again.
+	ErrHandlerError = errors.New("handler error")
+	// ErrHandlerFault is returned by Invoke when handler faults, handler
+	// can't be invoked again.
+	ErrHandlerFault = errors.New("handler fault")
 )
 
 const magic = 0x47697244
@@ -104,12 +111,11 @@ func (c *ControlConn) Invoke(ctx context.Context, args map[string]string) error
 		case cmdError:
 			log.Println("ERROR details:", a)
 			c.state = stateError
-			return nil
+			return ErrHandlerError
 		case cmdFault:
 			log.Println("ERROR details:", a)
 			c.state = stateFault
-			return nil
-			// todo: handle handler faults
+			return ErrHandlerFault
 		default:
 			log.Println("Unknown commandYYY:", cmd, c.state)
 			return errUnknownCommand
@@ -10,6 +10,8 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -27,6 +29,23 @@ type Function struct {
 	User    string
 	Group   string
 
+	// Cold is set for instances started on demand by FunctionPool.Get,
+	// their first invocation reports init duration.
+	Cold         bool
+	InitDuration time.Duration
+
+	// Started and Invocations are used to enforce FunctionPool limits.
+	Started     time.Time
+	Invocations int
+	// Generation of FunctionPool instance was started in.
+	Generation int
+
+	// LogStreamName is unique for each instance, like in lambda.
+	LogStreamName string
+
+	idleSince time.Time
+	release   func()
+
 	shmem   *shmem
 	control ControlConn
 	runtime *Runtime
@@ -42,6 +61,50 @@ type Runtime struct {
 	User        string
 	Group       string
 	Chroot      string
+
+	// Env variables in KEY=value form override runtime defaults.
+	Env []string
+
+	// Function configuration exposed to handler in reserved environment
+	// variables and invocation context.
+	FunctionName    string
+	FunctionVersion string
+	FunctionArn     string
+	Region          string
+	MemorySize      int
+
+	// Credentials are passed to handler at start and with every
+	// invocation, so warm instances get refreshed ones.
+	Credentials func() Credentials
+
+	// Mounts are bind mounted into sandbox after default mounts.
+	Mounts []Mount
+
+	// Network returns path of network namespace instance is started in
+	// and function releasing it after instance is closed. Without Network
+	// instances share host network.
+	Network func() (netns string, release func(), err error)
+}
+
+// Mount is bind mount of host file or dir into sandbox.
+type Mount struct {
+	Src string
+	Dst string
+	Rw  bool
+}
+
+// Credentials are AWS credentials of function.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+func (r *Runtime) credentials() Credentials {
+	if r.Credentials == nil {
+		return Credentials{}
+	}
+	return r.Credentials()
 }
 
 const (
@@ -49,11 +112,20 @@ const (
 )
 
 func NewFunction(r Runtime, dir, handler string) (f *Function, err error) {
+	start := time.Now()
+	if r.FunctionVersion == "" {
+		r.FunctionVersion = "$LATEST"
+	}
+	if r.MemorySize == 0 {
+		r.MemorySize = 128
+	}
+
 	f = new(Function)
 	f.runtime = &r
 	f.Handler = handler
 	f.User = r.User
 	f.Group = r.Group
+	f.LogStreamName = logStreamName(start, r.FunctionVersion)
 
 	f.Dir, err = filepath.Abs(dir)
 	if err != nil {
@@ -111,7 +183,7 @@ func NewFunction(r Runtime, dir, handler string) (f *Function, err error) {
 	f.Env = append(f.Env,
 		"_HANDLER="+f.Handler,
 
-		"AWS_LAMBDA_FUNCTION_NAME=test",
+		"AWS_LAMBDA_FUNCTION_NAME="+r.FunctionName,
 		"_X_AMZN_TRACE_ID=Parent=4631f93d66676d9e",
 		"_LAMBDA_RUNTIME_LOAD_TIME=10746081534797",
 		"_LAMBDA_SB_ID=0",
@@ -121,30 +193,52 @@ func NewFunction(r Runtime, dir, handler string) (f *Function, err error) {
 		"AWS_XRAY_DAEMON_ADDRESS=127.0.0.1:9090", // ip:port
 		"AWS_XRAY_CONTEXT_MISSING=ERROR",
 
-		"AWS_DEFAULT_REGION=not implemented",
-		"AWS_EXECUTION_ENV=not implemented",
-		"AWS_LAMBDA_FUNCTION_MEMORY_SIZE=not implemented",
-		"AWS_LAMBDA_FUNCTION_VERSION=not implemented",
-		"AWS_LAMBDA_LOG_GROUP_NAME=not implemented",
-		"AWS_LAMBDA_LOG_STREAM_NAME=not implemented",
+		"AWS_DEFAULT_REGION="+r.Region,
+		"AWS_EXECUTION_ENV=AWS_Lambda_"+r.Name,
+		"AWS_LAMBDA_FUNCTION_MEMORY_SIZE="+strconv.Itoa(r.MemorySize),
+		"AWS_LAMBDA_FUNCTION_VERSION="+r.FunctionVersion,
+		"AWS_LAMBDA_LOG_GROUP_NAME=/aws/lambda/"+r.FunctionName,
+		"AWS_LAMBDA_LOG_STREAM_NAME="+f.LogStreamName,
 		"AWS_LAMBDA_RUNTIME_API=not implemented",
-		"AWS_REGION=not implemented",
+		"AWS_REGION="+r.Region,
 
 		"LAMBDA_TASK_ROOT=/var/task",
 		"LAMBDA_RUNTIME_DIR=/var/runtime",
 		"LANG=en_US.UTF-8",
-		"LD_LIBRARY_PATH=/var/lang/lib:/lib64:/usr/lib64:/var/runtime:/var/runtime/lib:/var/task:/var/task/lib",
-		"PATH=/var/lang/bin:/usr/local/bin:/usr/bin/:/bin",
-		"PYTHONPATH=/tmp/:/var/task/:/var/runtime/",
+		"LD_LIBRARY_PATH=/var/lang/lib:/lib64:/usr/lib64:/var/runtime:/var/runtime/lib:/var/task:/var/task/lib:/opt/lib",
+		"NODE_PATH=/opt/nodejs/node_modules:/var/runtime/node_modules:/var/runtime:/var/task",
+		"PATH=/var/lang/bin:/usr/local/bin:/usr/bin/:/bin:/opt/bin",
+		"PYTHONPATH=/tmp/:/var/task/:/var/runtime/:/opt/python/:/opt/python/lib/"+r.Name+"/site-packages/",
 		"TZ=:UTC",
 		"LOG_LEVEL=DEBUG",
 	)
+	creds := r.credentials()
+	if creds.AccessKeyID != "" {
+		f.Env = append(f.Env,
+			"AWS_ACCESS_KEY_ID="+creds.AccessKeyID,
+			"AWS_SECRET_ACCESS_KEY="+creds.SecretAccessKey,
+		)
+		if creds.SessionToken != "" {
+			f.Env = append(f.Env, "AWS_SESSION_TOKEN="+creds.SessionToken)
+		}
+	}
+	f.Env = mergeEnv(f.Env, r.Env)
 
 	f.Configure = f.configure()
 	f.Stdout = os.Stdout
 	f.Stderr = os.Stderr
 
-	if err := f.Start(); err != nil {
+	var netns string
+	if r.Network != nil {
+		netns, f.release, err = r.Network()
+		if err != nil {
+			f.Freezer.Close()
+			f.shmem.Close()
+			return nil, err
+		}
+	}
+
+	if err := startInNetns(f.Freezer, netns); err != nil {
 		f.Close()
 		return nil, err
 	}
@@ -160,9 +254,9 @@ func NewFunction(r Runtime, dir, handler string) (f *Function, err error) {
 		"handler":     f.Handler,
 		"mode":        "event",
 		"supressinit": "0", // int
-		"awskey":      "not implemented",
-		"awssecret":   "not implemented",
-		"awssession":  "not implemented",
+		"awskey":      creds.AccessKeyID,
+		"awssecret":   creds.SecretAccessKey,
+		"awssession":  creds.SessionToken,
 	}
 
 	f.control = ControlConn{UnixConn: server}
@@ -170,6 +264,8 @@ func NewFunction(r Runtime, dir, handler string) (f *Function, err error) {
 		f.Close()
 		return nil, err
 	}
+	f.InitDuration = time.Since(start)
+	f.Started = start
 
 	// f.Stdout = nil
 	// f.Stderr = nil
@@ -180,6 +276,7 @@ func NewFunction(r Runtime, dir, handler string) (f *Function, err error) {
 func (f *Function) Invoke(ctx context.Context) error {
 	start := time.Now()
 	id := fakeGuid()
+	creds := f.runtime.credentials()
 
 	args := map[string]string{
 		"invokeid":           id,  //strconv.Itoa(f.invokeid),
@@ -187,29 +284,85 @@ func (f *Function) Invoke(ctx context.Context) error {
 		"deadlinens":         "0",
 		"mode":               "event",
 		"clientcontext":      "{}",
-		"x-amzn-trace-id":    "x=1",
-		"invokedFunctionArn": "not implemented",
-		"awskey":             "not implemented",
-		"awssecret":          "not implemented",
-		"awssession":         "not implemented",
+		"x-amzn-trace-id":    traceID(ctx),
+		"invokedFunctionArn": f.runtime.FunctionArn,
+		"awskey":             creds.AccessKeyID,
+		"awssecret":          creds.SecretAccessKey,
+		"awssession":         creds.SessionToken,
 		"cognitoidentityid":  "not implemented",
 		"cognitopoolid":      "not implemented",
 	}
 
-	fmt.Println("START RequestId:", id, "Version: $LATEST")
+	fmt.Println("START RequestId:", id, "Version:", f.runtime.FunctionVersion)
+	f.Invocations++
 
 	// run!
 	err := f.control.Invoke(ctx, args)
 
 	d := duration(start)
+	var init string
+	if f.Cold {
+		init = fmt.Sprintf("\tInit Duration: %.2f ms", float64(f.InitDuration.Nanoseconds())/1e6)
+	}
 	fmt.Printf(
-		"REPORT RequestId: %s\tDuration: %.2f ms\t Billed Duration: %.f ms\tMemory Size: %s MB\tMax Memory Used: %d MB\n",
-		id, d, math.Ceil(d/100)*100, "1024", -1,
+		"REPORT RequestId: %s\tDuration: %.2f ms\t Billed Duration: %.f ms\tMemory Size: %s MB\tMax Memory Used: %d MB%s\n",
+		id, d, math.Ceil(d/100)*100, strconv.Itoa(f.runtime.MemorySize), -1, init,
 	)
 	fmt.Println("END RequestId:", id)
 	return err
 }
 
+type traceKey struct{}
+
+// WithTraceID returns context carrying X-Ray trace header of invocation,
+// handler gets it in _X_AMZN_TRACE_ID.
+func WithTraceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceKey{}, id)
+}
+
+// TraceID returns trace header carried by context, if any.
+func TraceID(ctx context.Context) string {
+	id, _ := ctx.Value(traceKey{}).(string)
+	return id
+}
+
+func traceID(ctx context.Context) string {
+	if id := TraceID(ctx); id != "" {
+		return id
+	}
+	return "x=1"
+}
+
+// logStreamName returns log stream name in lambda format,
+// 2006/01/02/[$LATEST]<32 hex digits>.
+func logStreamName(t time.Time, version string) string {
+	var b [16]byte
+	rand.Read(b[:])
+	return t.UTC().Format("2006/01/02") + "/[" + version + "]" + hex.EncodeToString(b[:])
+}
+
+// mergeEnv replaces variables in env with ones from override, new
+// variables are appended.
+func mergeEnv(env, override []string) []string {
+	for _, kv := range override {
+		key := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			key = kv[:i]
+		}
+		replaced := false
+		for i := range env {
+			if strings.HasPrefix(env[i], key+"=") {
+				env[i] = kv
+				replaced = true
+			}
+		}
+		if !replaced {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
 func duration(start time.Time) float64 {
 	d := float64(time.Now().Sub(start).Nanoseconds())
 	return d / 1e6
@@ -276,6 +429,15 @@ func (fn *Function) configure() func(f *freezer.Freezer) *nsjailpb.NsJailConfig
 		// },
 	}
 
+	for _, m := range fn.runtime.Mounts {
+		mounts = append(mounts, &nsjailpb.MountPt{
+			Src:    proto.String(m.Src),
+			Dst:    proto.String(m.Dst),
+			IsBind: proto.Bool(true),
+			Rw:     proto.Bool(m.Rw),
+		})
+	}
+
 	// lang := filepath.Join(runtimeChroot, "var/lang")
 	// rapid := filepath.Join(runtimeChroot, "var/rapid")
 	// runtime := filepath.Join(runtimeChroot, "var/runtime")
@@ -341,6 +503,9 @@ func (fn *Function) configure() func(f *freezer.Freezer) *nsjailpb.NsJailConfig
 			RlimitNofileType: nsjailpb.RLimit_SOFT.Enum(),
 			TimeLimit:        proto.Uint32(0),
 			// CgroupMemMax:    proto.Uint64(3 * 1024 * 1024),
+			// nsjail stays in network namespace it is started in, isolated
+			// instances are started in their own one with setns, see
+			// startInNetns
 			CloneNewnet:   proto.Bool(false),
 			SeccompString: seccomp,
 		}
@@ -361,6 +526,10 @@ func (f *Function) Close() (err error) {
 	if err2 := f.Thaw(); err2 != nil {
 		err = err2
 	}
+	if f.release != nil {
+		f.release()
+		f.release = nil
+	}
 	// runtime.SetFinalizer(f, nil)
 	return err
 }
@@ -385,42 +554,201 @@ func (f *Function) Response() []byte {
 	return f.shmem.Response()
 }
 
+// FunctionPool reuses frozen instances. Purge starts a new generation of
+// instances, instances of older generations still serving invocations are
+// drained, they are closed when returned with Put.
 type FunctionPool struct {
 	New func() (f *Function, err error)
 
+	// Min is number of instances kept warm, like provisioned concurrency.
+	Min int
+
+	// IdleTimeout, MaxLifetime and MaxInvocations limit reuse of
+	// instances, zero means no limit. Idle instances over limits are
+	// closed by Reap.
+	IdleTimeout    time.Duration
+	MaxLifetime    time.Duration
+	MaxInvocations int
+
 	m            sync.Mutex
 	freeFunction []*Function
+	generation   int
+	// live counts instances of current generation, draining instances of
+	// older ones
+	live     int
+	draining int
 }
 
+// Get returns idle instance or starts new cold one.
 func (p *FunctionPool) Get() (f *Function, err error) {
 	p.m.Lock()
-	defer p.m.Unlock()
 	if n := len(p.freeFunction); n > 0 {
 		f = p.freeFunction[n-1]
 		p.freeFunction = p.freeFunction[:n-1]
+		p.m.Unlock()
 		return
 	}
-	return p.New()
+	gen := p.generation
+	p.live++
+	p.m.Unlock()
+
+	f, err = p.New()
+	if err != nil {
+		p.m.Lock()
+		p.release(gen)
+		p.m.Unlock()
+		return
+	}
+	f.Generation = gen
+	f.Cold = true
+	return
 }
 
+// Put returns instance to pool, instances of older generations or over
+// lifetime or invocation limits are closed.
 func (p *FunctionPool) Put(f *Function) {
+	f.Cold = false
+	f.idleSince = time.Now()
+
 	p.m.Lock()
+	if f.Generation != p.generation || p.retired(f, f.idleSince) {
+		p.release(f.Generation)
+		p.m.Unlock()
+		f.Close()
+		return
+	}
 	p.freeFunction = append(p.freeFunction, f)
 	p.m.Unlock()
 }
 
-func (p *FunctionPool) Purge() error {
+// release forgets instance of generation, must be called with lock held.
+func (p *FunctionPool) release(gen int) {
+	if gen == p.generation {
+		p.live--
+	} else {
+		p.draining--
+	}
+}
+
+// retired reports whether instance is over lifetime or invocation limit.
+func (p *FunctionPool) retired(f *Function, now time.Time) bool {
+	return p.MaxLifetime > 0 && now.Sub(f.Started) >= p.MaxLifetime ||
+		p.MaxInvocations > 0 && f.Invocations >= p.MaxInvocations
+}
+
+// Reap closes idle instances over limits, it returns number of closed
+// instances. Idle timeout does not apply to Min instances kept warm.
+func (p *FunctionPool) Reap() (n int, err error) {
+	now := time.Now()
+
+	var expired []*Function
+	p.m.Lock()
+	free := p.freeFunction[:0]
+	for _, f := range p.freeFunction {
+		idle := p.IdleTimeout > 0 && now.Sub(f.idleSince) >= p.IdleTimeout &&
+			p.live-len(expired) > p.Min
+		if idle || p.retired(f, now) {
+			expired = append(expired, f)
+		} else {
+			free = append(free, f)
+		}
+	}
+	for i := len(free); i < len(p.freeFunction); i++ {
+		p.freeFunction[i] = nil
+	}
+	p.freeFunction = free
+	p.live -= len(expired)
+	p.m.Unlock()
+
+	for _, f := range expired {
+		if err2 := f.Close(); err2 != nil {
+			err = err2
+		}
+	}
+	return len(expired), err
+}
+
+// Discard closes instance taken from pool instead of returning it.
+func (p *FunctionPool) Discard(f *Function) error {
+	p.m.Lock()
+	p.release(f.Generation)
+	p.m.Unlock()
+	return f.Close()
+}
+
+// Prewarm starts frozen instances in parallel until Min instances are
+// live, it returns number of instances started.
+func (p *FunctionPool) Prewarm() (int, error) {
+	p.m.Lock()
+	gen := p.generation
+	n := p.Min - p.live
+	if n <= 0 {
+		p.m.Unlock()
+		return 0, nil
+	}
+	p.live += n
+	p.m.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := p.New()
+			if err == nil {
+				if err = f.Freeze(); err != nil {
+					f.Close()
+				}
+			}
+			if err != nil {
+				p.m.Lock()
+				p.release(gen)
+				p.m.Unlock()
+				errs <- err
+				return
+			}
+			f.Generation = gen
+			p.Put(f)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	failed := len(errs)
+	return n - failed, <-errs
+}
+
+// Purge starts new generation and closes idle instances, instances in use
+// are drained.
+func (p *FunctionPool) Purge() (err error) {
 	p.m.Lock()
 	defer p.m.Unlock()
+	p.generation++
+	p.draining += p.live - len(p.freeFunction)
+	p.live = 0
 	for n := len(p.freeFunction); n > 0; n-- {
 		f := p.freeFunction[n-1]
 		p.freeFunction = p.freeFunction[:n-1]
-		if err := f.Close(); err != nil {
-			return err
+		if err2 := f.Close(); err2 != nil {
+			err = err2
 		}
 	}
+	return err
+}
 
-	return nil
+// Generation returns current generation of instances.
+func (p *FunctionPool) Generation() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.generation
+}
+
+// Draining returns number of instances of older generations still in use.
+func (p *FunctionPool) Draining() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.draining
 }
 
 type filer interface {
@@ -0,0 +1,82 @@
+package subslicer
+
+import (
+	"net"
+	"os"
+	"runtime"
+
+	"github.com/dzeromsk/subslicer/freezer"
+	"golang.org/x/sys/unix"
+)
+
+// startInNetns starts sandbox in network namespace netns, empty netns
+// starts it in host network. Sandbox does not clone network namespace so
+// it inherits one of the thread forking it.
+func startInNetns(f *freezer.Freezer, netns string) error {
+	if netns == "" {
+		return f.Start()
+	}
+
+	ns, err := os.Open(netns)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		// thread is never unlocked, it exits with goroutine instead of
+		// going back to scheduler in wrong namespace
+		runtime.LockOSThread()
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			errc <- err
+			return
+		}
+		errc <- f.Start()
+	}()
+	return <-errc
+}
+
+// ListenInNetns listens on address in network namespace netns, listener
+// stays in namespace and may be used from any goroutine.
+func ListenInNetns(netns, network, address string) (l net.Listener, err error) {
+	ns, err := os.Open(netns)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runtime.LockOSThread()
+		if err = unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			return
+		}
+		l, err = net.Listen(network, address)
+	}()
+	<-done
+	return l, err
+}
+
+// ListenPacketInNetns listens on packet address in network namespace
+// netns, like ListenInNetns.
+func ListenPacketInNetns(netns, network, address string) (c net.PacketConn, err error) {
+	ns, err := os.Open(netns)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runtime.LockOSThread()
+		if err = unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			return
+		}
+		c, err = net.ListenPacket(network, address)
+	}()
+	<-done
+	return c, err
+}